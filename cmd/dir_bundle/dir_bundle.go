@@ -0,0 +1,573 @@
+package dirbundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+	"amalitech.org/subsys/utils"
+)
+
+// BundleVersion is bumped whenever the bundle layout changes.
+const BundleVersion = 1
+
+const BundleExtension = ".subsys-bundle"
+
+const headerName = "bundle.json"
+
+var objectName = regexp.MustCompile(`^objects/([0-9a-f]{64})$`)
+
+// BundleSnapshot lists a snapshot in a bundle, with the SHA-256 of its JSON.
+type BundleSnapshot struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+// BundleHeader is the first entry of a bundle. It's followed by the snapshots
+// under snapshots/, and the objects they use, still deflated, under objects/.
+type BundleHeader struct {
+	Version       int                    `json:"version"`
+	CreatedAt     time.Time              `json:"createdAt"`
+	SubsysVersion string                 `json:"subsysVersion"`
+	Assignment    utils.AssignmentConfig `json:"assignment"`
+	Snapshots     []BundleSnapshot       `json:"snapshots"`
+	ObjectCount   int                    `json:"objectCount"`
+}
+
+type BundleManager struct {
+	Path   string
+	Into   string
+	Force  bool
+	Output io.Writer
+}
+
+// NewBundleManager needs no config, as bundles are often imported into a
+// lecturer's inbox rather than a subsys directory.
+func NewBundleManager() *BundleManager {
+	return &BundleManager{
+		Output: os.Stdout,
+	}
+}
+
+func (bm *BundleManager) ManageBundles() error {
+	if len(os.Args) < 3 {
+		return errors.New("specify what to do: export or import")
+	}
+
+	flags := flag.NewFlagSet("bundle "+os.Args[2], flag.ContinueOnError)
+	flags.StringVar(&bm.Path, "output", "", "File to export the bundle to")
+	flags.StringVar(&bm.Into, "into", "", "Inbox directory to import the bundle into, in a directory per assignment and student")
+	flags.BoolVar(&bm.Force, "force", false, "Replace snapshots that already exist with different contents")
+
+	args, err := utils.ParseInterspersed(flags, os.Args[3:])
+	if err != nil {
+		return err
+	}
+	bm.Path = utils.UserPath(bm.Path)
+	bm.Into = utils.UserPath(bm.Into)
+
+	switch os.Args[2] {
+	case "export":
+		return bm.Export(args)
+	case "import":
+		if len(args) != 1 {
+			return errors.New("usage: subsys bundle import <bundle> [--into <inbox>]")
+		}
+		return bm.Import(utils.UserPath(args[0]))
+	default:
+		return fmt.Errorf("unknown bundle command %s, use export or import", os.Args[2])
+	}
+}
+
+// Export writes the named snapshots, or every snapshot, to a bundle along with
+// the snapshots they descend from, so the history comes with them.
+func (bm *BundleManager) Export(names []string) error {
+	config, err := utils.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := bundledSnapshots(names)
+	if err != nil {
+		return err
+	}
+
+	if len(snapshots) == 0 {
+		return errors.New("you have no snapshots to export, first create a snapshot with the subsys snap command")
+	}
+
+	if bm.Path == "" {
+		bm.Path = defaultBundleName(config)
+	}
+
+	// The bundle is only put in place once it's complete, so an interrupted
+	// export can't leave half of one behind
+	file, err := os.CreateTemp(filepath.Dir(bm.Path), "."+filepath.Base(bm.Path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	hasher := sha256.New()
+	header, err := writeBundle(io.MultiWriter(file, hasher), config, snapshots)
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(file.Name(), bm.Path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(bm.Output, "Exported %d snapshot(s) and %d object(s) to %s\n", len(header.Snapshots), header.ObjectCount, bm.Path)
+	fmt.Fprintf(bm.Output, "Bundle SHA-256: %s\n", hex.EncodeToString(hasher.Sum(nil)))
+
+	return nil
+}
+
+// bundledSnapshots loads the named snapshots and their ancestors, oldest first.
+func bundledSnapshots(names []string) ([]dirsnap.Snapshot, error) {
+	all, err := dirsnap.ListSnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		return all, nil
+	}
+
+	byName := make(map[string]dirsnap.Snapshot, len(all))
+	for _, snapshot := range all {
+		byName[snapshot.Name] = snapshot
+	}
+
+	wanted := map[string]bool{}
+	for _, name := range names {
+		if _, ok := byName[name]; !ok {
+			if dirsnap.SnapshotExists(name) {
+				return nil, fmt.Errorf("%s was made by an older version of subsys and can't be bundled", name)
+			}
+			return nil, fmt.Errorf("you don't have a snapshot named %s", name)
+		}
+
+		for current := name; current != "" && !wanted[current]; current = byName[current].Parent {
+			if _, ok := byName[current]; !ok {
+				break
+			}
+			wanted[current] = true
+		}
+	}
+
+	snapshots := make([]dirsnap.Snapshot, 0, len(wanted))
+	for _, snapshot := range all {
+		if wanted[snapshot.Name] {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	return snapshots, nil
+}
+
+func defaultBundleName(config utils.AssignmentConfig) string {
+	parts := make([]string, 0, 2)
+	for _, part := range []string{config.AssignmentCode, config.StudentID} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	if len(parts) == 0 {
+		parts = append(parts, "snapshots")
+	}
+
+	return strings.Join(parts, "-") + BundleExtension
+}
+
+func writeBundle(w io.Writer, config utils.AssignmentConfig, snapshots []dirsnap.Snapshot) (BundleHeader, error) {
+	header := BundleHeader{
+		Version:       BundleVersion,
+		CreatedAt:     time.Now().UTC(),
+		SubsysVersion: utils.Version,
+		Assignment:    config,
+		Snapshots:     make([]BundleSnapshot, 0, len(snapshots)),
+	}
+
+	documents := make([][]byte, 0, len(snapshots))
+	objects := map[string]bool{}
+	for _, snapshot := range snapshots {
+		data, err := os.ReadFile(dirsnap.SnapshotPath(snapshot.Name))
+		if err != nil {
+			return header, err
+		}
+
+		sum := sha256.Sum256(data)
+		header.Snapshots = append(header.Snapshots, BundleSnapshot{Name: snapshot.Name, SHA256: hex.EncodeToString(sum[:])})
+		documents = append(documents, data)
+
+		for _, file := range snapshot.Files {
+			objects[file.Hash] = true
+		}
+	}
+
+	hashes := make([]string, 0, len(objects))
+	for hash := range objects {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	header.ObjectCount = len(hashes)
+
+	headerData, err := json.MarshalIndent(header, "", "  ")
+	if err != nil {
+		return header, err
+	}
+
+	writer := tar.NewWriter(w)
+
+	err = writeBundleEntry(writer, headerName, header.CreatedAt, int64(len(headerData)), bytes.NewReader(headerData))
+	if err != nil {
+		return header, err
+	}
+
+	for i, snapshot := range header.Snapshots {
+		err = writeBundleEntry(writer, "snapshots/"+snapshot.Name+".json", header.CreatedAt, int64(len(documents[i])), bytes.NewReader(documents[i]))
+		if err != nil {
+			return header, err
+		}
+	}
+
+	for _, hash := range hashes {
+		err = writeBundleObject(writer, hash, header.CreatedAt)
+		if err != nil {
+			return header, err
+		}
+	}
+
+	return header, writer.Close()
+}
+
+func writeBundleObject(writer *tar.Writer, hash string, modTime time.Time) error {
+	object, err := utils.OpenRawObject(hash)
+	if err != nil {
+		return fmt.Errorf("object %s is missing from your snapshots: %v", hash, err)
+	}
+	defer object.Close()
+
+	info, err := object.Stat()
+	if err != nil {
+		return err
+	}
+
+	return writeBundleEntry(writer, "objects/"+hash, modTime, info.Size(), object)
+}
+
+func writeBundleEntry(writer *tar.Writer, name string, modTime time.Time, size int64, contents io.Reader) error {
+	err := writer.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, contents)
+	return err
+}
+
+// Import loads a bundle into the current subsys directory or, with --into,
+// into the inbox directory of the bundle's assignment and student.
+func (bm *BundleManager) Import(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := tar.NewReader(file)
+	header, err := readBundleHeader(reader)
+	if err != nil {
+		return err
+	}
+
+	if bm.Into != "" {
+		restore, err := bm.enterInbox(header.Assignment)
+		if err != nil {
+			return err
+		}
+		defer restore()
+	} else {
+		config, err := utils.GetConfig()
+		if err != nil {
+			return err
+		}
+
+		if config.AssignmentCode != "" && header.Assignment.AssignmentCode != "" && config.AssignmentCode != header.Assignment.AssignmentCode {
+			fmt.Fprintf(bm.Output, "Warning: the bundle is for assignment %s, but this directory is for %s\n", header.Assignment.AssignmentCode, config.AssignmentCode)
+		}
+	}
+
+	snapshots, err := readBundleEntries(reader, header)
+	if err != nil {
+		return fmt.Errorf("%s is damaged: %v", filepath.Base(path), err)
+	}
+
+	return bm.saveSnapshots(header, snapshots)
+}
+
+func readBundleHeader(reader *tar.Reader) (BundleHeader, error) {
+	var header BundleHeader
+
+	entry, err := reader.Next()
+	if err != nil || entry.Name != headerName {
+		return header, errors.New("not a subsys bundle")
+	}
+
+	err = json.NewDecoder(reader).Decode(&header)
+	if err != nil {
+		return header, fmt.Errorf("not a subsys bundle: %v", err)
+	}
+
+	if header.Version > BundleVersion {
+		return header, fmt.Errorf("the bundle was made by subsys v%s, which is newer than this one, please update subsys", header.SubsysVersion)
+	}
+
+	for _, snapshot := range header.Snapshots {
+		err = dirsnap.ValidateSnapshotName(snapshot.Name)
+		if err != nil {
+			return header, err
+		}
+	}
+
+	return header, nil
+}
+
+// readBundleEntries stores the bundle's objects, checking each against its
+// hash, and returns its snapshots, checked against the header.
+func readBundleEntries(reader *tar.Reader, header BundleHeader) (map[string][]byte, error) {
+	expected := make(map[string]string, len(header.Snapshots))
+	for _, snapshot := range header.Snapshots {
+		expected["snapshots/"+snapshot.Name+".json"] = snapshot.SHA256
+	}
+
+	documents := map[string][]byte{}
+	objects := 0
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if match := objectName.FindStringSubmatch(entry.Name); match != nil {
+			err = utils.StoreRawObject(match[1], reader)
+			if err != nil {
+				return nil, err
+			}
+			objects++
+			continue
+		}
+
+		sum, ok := expected[entry.Name]
+		if !ok {
+			return nil, fmt.Errorf("unexpected entry %s", entry.Name)
+		}
+
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		actual := sha256.Sum256(data)
+		if hex.EncodeToString(actual[:]) != sum {
+			return nil, fmt.Errorf("%s doesn't match the bundle's header", entry.Name)
+		}
+
+		name := strings.TrimSuffix(strings.TrimPrefix(entry.Name, "snapshots/"), ".json")
+		documents[name] = data
+	}
+
+	if len(documents) != len(header.Snapshots) {
+		return nil, fmt.Errorf("expected %d snapshot(s), found %d", len(header.Snapshots), len(documents))
+	}
+
+	if objects != header.ObjectCount {
+		return nil, fmt.Errorf("expected %d object(s), found %d", header.ObjectCount, objects)
+	}
+
+	return documents, nil
+}
+
+// saveSnapshots adds the bundle's snapshots once every one of them checks out.
+// Nothing is replaced unless --force is given, except by an identical snapshot.
+func (bm *BundleManager) saveSnapshots(header BundleHeader, documents map[string][]byte) error {
+	snapshots := make([]dirsnap.Snapshot, 0, len(header.Snapshots))
+	skip := map[string]bool{}
+
+	for _, entry := range header.Snapshots {
+		var snapshot dirsnap.Snapshot
+		err := json.Unmarshal(documents[entry.Name], &snapshot)
+		if err != nil {
+			return fmt.Errorf("snapshot %s is damaged: %v", entry.Name, err)
+		}
+
+		if snapshot.Name != entry.Name {
+			return fmt.Errorf("snapshot %s is named %s inside", entry.Name, snapshot.Name)
+		}
+
+		err = snapshot.Validate()
+		if err != nil {
+			return err
+		}
+
+		for _, file := range snapshot.Files {
+			if !utils.HasObject(file.Hash) {
+				return fmt.Errorf("snapshot %s is missing the contents of %s", snapshot.Name, file.Path)
+			}
+		}
+
+		if snapshot.ArchiveSHA256 != "" {
+			hash, err := snapshot.ArchiveHash()
+			if err != nil {
+				return err
+			}
+			if hash != snapshot.ArchiveSHA256 {
+				return fmt.Errorf("snapshot %s doesn't match its recorded archive SHA-256", snapshot.Name)
+			}
+		}
+
+		if dirsnap.SnapshotExists(snapshot.Name) {
+			existing, err := dirsnap.LoadSnapshot(snapshot.Name)
+			if err == nil && existing.ArchiveSHA256 != "" && existing.ArchiveSHA256 == snapshot.ArchiveSHA256 {
+				skip[snapshot.Name] = true
+			} else if !bm.Force {
+				return fmt.Errorf("a snapshot named %s already exists, use --force to replace it", snapshot.Name)
+			}
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	for _, snapshot := range snapshots {
+		if skip[snapshot.Name] {
+			fmt.Fprintf(bm.Output, "Already have snapshot %s\n", snapshot.Name)
+			continue
+		}
+
+		err := utils.WriteFileAtomic(dirsnap.SnapshotPath(snapshot.Name), documents[snapshot.Name], 0644)
+		if err != nil {
+			return err
+		}
+		os.Remove(dirsnap.LegacySnapshotPath(snapshot.Name))
+
+		fmt.Fprintf(bm.Output, "Imported snapshot %s\n", snapshot.Name)
+	}
+
+	directory, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(bm.Output, "Imported %d snapshot(s) into %s\n", len(snapshots)-len(skip), directory)
+	return nil
+}
+
+// enterInbox changes to the inbox directory of an assignment and student,
+// making it a subsys directory with the bundle's config if it isn't one yet.
+// The inbox is locked until the returned function changes back, as it isn't
+// the directory subsys was run in and locked for.
+func (bm *BundleManager) enterInbox(assignment utils.AssignmentConfig) (func(), error) {
+	parts := []string{bm.Into}
+	for _, part := range []string{assignment.AssignmentCode, assignment.StudentID} {
+		if part == "" {
+			part = "unknown"
+		}
+		if part == "." || part == ".." || strings.ContainsAny(part, `/\`) {
+			return nil, fmt.Errorf("the bundle's assignment or student ID %q can't be used as a directory name", part)
+		}
+		parts = append(parts, part)
+	}
+	directory := filepath.Join(parts...)
+
+	directory, err := filepath.Abs(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Join(directory, ".subsys", "snapshots"), 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := utils.LockDirectory(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeInboxConfig(directory, assignment)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+
+	previous, err := os.Getwd()
+	if err == nil {
+		err = os.Chdir(directory)
+	}
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+
+	return func() {
+		os.Chdir(previous)
+		lock.Unlock()
+	}, nil
+}
+
+func writeInboxConfig(directory string, assignment utils.AssignmentConfig) error {
+	configPath := filepath.Join(directory, ".subsys", "config.json")
+	if _, err := os.Stat(configPath); !os.IsNotExist(err) {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(assignment, "", "")
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(configPath, data, 0666)
+}
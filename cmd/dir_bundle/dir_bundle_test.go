@@ -0,0 +1,349 @@
+package dirbundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dirinit "amalitech.org/subsys/cmd/dir_init"
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+	"amalitech.org/subsys/utils"
+)
+
+func initDirectory(t *testing.T, dir string) {
+	err := os.Chdir(dir)
+	if err != nil {
+		t.Fatalf("Failed to change working directory: %v", err)
+	}
+
+	initializer, err := dirinit.NewDirectoryInitializer()
+	if err != nil {
+		t.Fatalf("NewDirectoryInitializer failed: %v", err)
+	}
+
+	err = initializer.Initialize()
+	if err != nil {
+		t.Fatalf("InitializeDirectory failed: %v", err)
+	}
+}
+
+// SetupBundleTests makes a configured directory with two snapshots and
+// returns the path of a bundle exported from it.
+func SetupBundleTests(t *testing.T, names ...string) (*BundleManager, string) {
+	initDirectory(t, t.TempDir())
+
+	config, err := utils.GetConfig()
+	if err != nil {
+		t.Fatalf("GetConfig failed: %v", err)
+	}
+	config.AssignmentCode = "CS101"
+	config.StudentID = "s123"
+	data, _ := json.Marshal(config)
+	os.WriteFile(filepath.Join(".subsys", "config.json"), data, 0666)
+
+	os.WriteFile("main.py", []byte("print('hello')"), 0644)
+	os.Args = []string{"program", "snap", "--name", "first"}
+	err = dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	os.WriteFile("main.py", []byte("print('hello world')"), 0644)
+	os.WriteFile("util.py", []byte("def util(): pass"), 0644)
+	os.Args = []string{"program", "snap", "--name", "second"}
+	err = dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	bm := NewBundleManager()
+	bm.Output = &bytes.Buffer{}
+	bm.Path = filepath.Join(t.TempDir(), "work"+BundleExtension)
+
+	err = bm.Export(names)
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	return bm, bm.Path
+}
+
+func TestExportImport(t *testing.T) {
+	bm, path := SetupBundleTests(t)
+
+	output := bm.Output.(*bytes.Buffer).String()
+	if !strings.Contains(output, "Exported 2 snapshot(s) and 3 object(s)") || !strings.Contains(output, "Bundle SHA-256: ") {
+		t.Errorf("Unexpected export output: %s", output)
+	}
+
+	original, _ := dirsnap.LoadSnapshot("second")
+
+	initDirectory(t, t.TempDir())
+	err := bm.Import(path)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+
+	snapshots, err := dirsnap.ListSnapshots()
+	if err != nil {
+		t.Fatalf("ListSnapshots failed: %v", err)
+	}
+	if len(snapshots) != 2 || snapshots[1].Name != "second" || snapshots[1].Parent != "first" {
+		t.Fatalf("Expected the history to be imported, got %+v", snapshots)
+	}
+
+	hash, err := snapshots[1].ArchiveHash()
+	if err != nil || hash != original.ArchiveSHA256 {
+		t.Errorf("Expected the imported snapshot to build the same archive, got %s, %v", hash, err)
+	}
+
+	// Importing again changes nothing
+	bm.Output = &bytes.Buffer{}
+	err = bm.Import(path)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if !strings.Contains(bm.Output.(*bytes.Buffer).String(), "Already have snapshot second") {
+		t.Errorf("Expected identical snapshots to be skipped, got %s", bm.Output.(*bytes.Buffer).String())
+	}
+}
+
+func TestExportIncludesHistory(t *testing.T) {
+	bm, path := SetupBundleTests(t, "second")
+
+	initDirectory(t, t.TempDir())
+	err := bm.Import(path)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+
+	if !dirsnap.SnapshotExists("first") || !dirsnap.SnapshotExists("second") {
+		t.Errorf("Expected the snapshot's ancestors to be exported with it")
+	}
+}
+
+func TestImportIntoInbox(t *testing.T) {
+	bm, path := SetupBundleTests(t)
+	inbox := t.TempDir()
+
+	bm.Into = inbox
+	err := bm.Import(path)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+
+	directory := filepath.Join(inbox, "CS101", "s123")
+	if _, err := os.Stat(filepath.Join(directory, ".subsys", "snapshots", "second.json")); err != nil {
+		t.Errorf("Expected the snapshots in the student's inbox: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(directory, ".subsys", "config.json"))
+	if err != nil || !strings.Contains(string(data), "s123") {
+		t.Errorf("Expected the inbox to get the bundle's config, got %s, %v", data, err)
+	}
+
+	working, _ := os.Getwd()
+	if strings.HasPrefix(working, inbox) {
+		t.Errorf("Expected to be back in the original directory, in %s", working)
+	}
+
+	if _, err := os.Stat(utils.LockPath(directory)); !os.IsNotExist(err) {
+		t.Errorf("Expected the inbox to be unlocked after importing")
+	}
+}
+
+func TestImportIntoLockedInbox(t *testing.T) {
+	bm, path := SetupBundleTests(t)
+	inbox := t.TempDir()
+
+	directory := filepath.Join(inbox, "CS101", "s123")
+	os.MkdirAll(filepath.Join(directory, ".subsys"), 0777)
+	lock, err := utils.LockDirectory(directory)
+	if err != nil {
+		t.Fatalf("LockDirectory failed: %v", err)
+	}
+	defer lock.Unlock()
+
+	bm.Into = inbox
+	err = bm.Import(path)
+	if !errors.Is(err, utils.ErrLocked) {
+		t.Fatalf("Expected importing into a locked inbox to fail, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(directory, ".subsys", "snapshots", "second.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be imported into a locked inbox")
+	}
+}
+
+func TestImportConflict(t *testing.T) {
+	bm, path := SetupBundleTests(t)
+
+	initDirectory(t, t.TempDir())
+	os.WriteFile("main.py", []byte("something else"), 0644)
+	os.Args = []string{"program", "snap", "--name", "first"}
+	err := dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	err = bm.Import(path)
+	if err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Fatalf("Expected a conflicting snapshot to be refused, got %v", err)
+	}
+	if dirsnap.SnapshotExists("second") {
+		t.Errorf("Expected nothing to be imported when a snapshot conflicts")
+	}
+
+	bm.Force = true
+	err = bm.Import(path)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if !dirsnap.SnapshotExists("second") {
+		t.Errorf("Expected --force to import the bundle")
+	}
+}
+
+// rewriteBundle copies a bundle, passing every entry's contents through edit.
+func rewriteBundle(t *testing.T, path string, edit func(name string, data []byte) []byte) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read bundle: %v", err)
+	}
+
+	var out bytes.Buffer
+	reader := tar.NewReader(bytes.NewReader(file))
+	writer := tar.NewWriter(&out)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read bundle: %v", err)
+		}
+
+		data, _ := io.ReadAll(reader)
+		data = edit(header.Name, data)
+		header.Size = int64(len(data))
+		writer.WriteHeader(header)
+		writer.Write(data)
+	}
+	writer.Close()
+
+	os.WriteFile(path, out.Bytes(), 0644)
+}
+
+func TestImportDamagedBundle(t *testing.T) {
+	tests := []struct {
+		name     string
+		edit     func(name string, data []byte) []byte
+		expected string
+	}{
+		{
+			name: "altered snapshot",
+			edit: func(name string, data []byte) []byte {
+				if name == "snapshots/first.json" {
+					return bytes.Replace(data, []byte(`"first"`), []byte(`"frist"`), 1)
+				}
+				return data
+			},
+			expected: "doesn't match the bundle's header",
+		},
+		{
+			name: "altered object",
+			edit: func(name string, data []byte) []byte {
+				if strings.HasPrefix(name, "objects/") {
+					data[len(data)/2] ^= 0xff
+				}
+				return data
+			},
+			expected: "is corrupt",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bm, path := SetupBundleTests(t)
+			rewriteBundle(t, path, test.edit)
+
+			initDirectory(t, t.TempDir())
+			err := bm.Import(path)
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Fatalf("Expected an error containing %q, got %v", test.expected, err)
+			}
+			if dirsnap.SnapshotExists("second") {
+				t.Errorf("Expected nothing to be imported from a damaged bundle")
+			}
+		})
+	}
+}
+
+func TestImportNotABundle(t *testing.T) {
+	bm, _ := SetupBundleTests(t)
+
+	path := filepath.Join(t.TempDir(), "notes.txt")
+	os.WriteFile(path, []byte("not a bundle"), 0644)
+
+	err := bm.Import(path)
+	if err == nil || !strings.Contains(err.Error(), "not a subsys bundle") {
+		t.Errorf("Expected a plain file to be rejected, got %v", err)
+	}
+}
+
+func TestImportUnsafeSnapshot(t *testing.T) {
+	tests := map[string][2]string{
+		"parent directory": {`"path": "main.py"`, `"path": "../main.py"`},
+		"absolute path":    {`"path": "main.py"`, `"path": "/tmp/main.py"`},
+		"subsys directory": {`"path": "main.py"`, `"path": ".subsys/config.json"`},
+		"unclean path":     {`"path": "main.py"`, `"path": "./main.py"`},
+		"short hash":       {`"hash": "`, `"hash": "a", "old": "`},
+	}
+
+	for name, replace := range tests {
+		t.Run(name, func(t *testing.T) {
+			bm, path := SetupBundleTests(t)
+
+			// A malicious bundle has a header that matches its snapshots
+			sums := map[string]string{}
+			rewriteBundle(t, path, func(entry string, data []byte) []byte {
+				if entry == "snapshots/second.json" {
+					data = bytes.ReplaceAll(data, []byte(replace[0]), []byte(replace[1]))
+					sum := sha256.Sum256(data)
+					sums["second"] = hex.EncodeToString(sum[:])
+				}
+				return data
+			})
+			rewriteBundle(t, path, func(entry string, data []byte) []byte {
+				if entry != headerName {
+					return data
+				}
+				var header BundleHeader
+				json.Unmarshal(data, &header)
+				for i := range header.Snapshots {
+					if sum, ok := sums[header.Snapshots[i].Name]; ok {
+						header.Snapshots[i].SHA256 = sum
+					}
+				}
+				data, _ = json.Marshal(header)
+				return data
+			})
+
+			initDirectory(t, t.TempDir())
+			err := bm.Import(path)
+			if err == nil || !strings.Contains(err.Error(), "snapshot second") {
+				t.Fatalf("Expected the snapshot to be refused, got %v", err)
+			}
+			if dirsnap.SnapshotExists("second") {
+				t.Errorf("Expected nothing to be imported from an unsafe bundle")
+			}
+		})
+	}
+}
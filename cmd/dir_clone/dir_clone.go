@@ -1,16 +1,19 @@
 package dirclone
 
 import (
-	"archive/zip"
-	"bytes"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
 	"amalitech.org/subsys/utils"
 )
 
@@ -26,16 +29,42 @@ type CloneManager struct {
 	LectureCode   string
 	SubmissionID  string
 	SnapshotID    string
+	Identity      string
+	Key           string
+	manifest      *dirsnap.ArchiveManifest
+}
+
+// decrypt opens an archive that was encrypted to the lecturer's key.
+func (cm *CloneManager) decrypt(data []byte) ([]byte, error) {
+	key, err := utils.LoadIdentity(cm.Identity)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("this snapshot is encrypted and there's no private key at %s, give yours with --identity", cm.Identity)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Decrypting the snapshot with", cm.Identity)
+	return utils.Decrypt(data, key)
 }
 
 func NewCloneManager() *CloneManager {
 	return &CloneManager{
 		ServerUrl: "https://gitinspired-rw-api.amalitech-dev.net/api",
+		Identity:  utils.DefaultIdentityPath,
 	}
 }
 
 func (cm *CloneManager) CloneSnapshot() error {
-	err := cm.getDataInteractively()
+	flags := flag.NewFlagSet("clone", flag.ContinueOnError)
+	flags.StringVar(&cm.Identity, "identity", cm.Identity, "Private key to decrypt encrypted submissions with")
+	flags.StringVar(&cm.Key, "key", "", "Public key registered for the student, the snapshot must be signed with it")
+	err := flags.Parse(os.Args[2:])
+	if err != nil {
+		return err
+	}
+
+	err = cm.getDataInteractively()
 	if err != nil {
 		return err
 	}
@@ -45,11 +74,66 @@ func (cm *CloneManager) CloneSnapshot() error {
 		return err
 	}
 
+	// Hooks come from the subsys directory the snapshot is cloned in, if any
+	root, err := utils.FindRoot(".")
+	if err != nil && !errors.Is(err, utils.ErrNoRoot) {
+		return err
+	}
+
 	err = cm.DownloadSnapshot()
 	if err != nil {
 		return err
 	}
 
+	if root == "" {
+		return nil
+	}
+
+	return utils.RunHook(root, utils.PostCloneHook, ".", cm.hookEnv())
+}
+
+// hookEnv describes the clone to the post-clone hook, which runs in the
+// directory it was extracted to.
+func (cm *CloneManager) hookEnv() map[string]string {
+	env := map[string]string{
+		"SUBMISSION_ID": cm.SubmissionID,
+		"SNAPSHOT_ID":   cm.SnapshotID,
+	}
+
+	if directory, err := os.Getwd(); err == nil {
+		env["CLONE_DIR"] = directory
+	}
+
+	if cm.manifest != nil {
+		env["SNAPSHOT"] = cm.manifest.Snapshot
+		env["ASSIGNMENT"] = cm.manifest.Assignment.AssignmentCode
+		env["STUDENT_ID"] = cm.manifest.Assignment.StudentID
+		env["PROJECT"] = cm.manifest.Assignment.ProjectName
+	}
+
+	return env
+}
+
+// checkSigner makes sure the snapshot was signed with the key registered for
+// the student, when it was given. Without it the signer can't be trusted, as
+// anyone can sign a snapshot with a key of their own.
+func (cm *CloneManager) checkSigner(manifest dirsnap.ArchiveManifest) error {
+	if cm.Key != "" {
+		err := manifest.CheckSigner(cm.Key)
+		if err != nil {
+			return fmt.Errorf("%v, it may not come from student %s", err, manifest.Assignment.StudentID)
+		}
+
+		fmt.Printf("Signed with the key registered for student %s, %s\n", manifest.Assignment.StudentID, manifest.Signature.Fingerprint())
+		return nil
+	}
+
+	if manifest.Signature == nil {
+		fmt.Println("Warning: this snapshot isn't signed, so it can't be traced to the student's key")
+		return nil
+	}
+
+	fmt.Printf("Warning: this snapshot is signed with key %s, which wasn't checked. Give the key registered for student %s with --key to make sure it's theirs\n", manifest.Signature.Fingerprint(), manifest.Assignment.StudentID)
 	return nil
 }
 
@@ -124,6 +208,56 @@ func (cm *CloneManager) DownloadSnapshot() error {
 		return err
 	}
 
+	if utils.IsEncrypted(body) {
+		body, err = cm.decrypt(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	format, err := dirsnap.DetectArchiveFormat(body)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	// Check the files weren't altered before writing any of them
+	manifest, err := dirsnap.VerifyArchive(body)
+	if errors.Is(err, dirsnap.ErrNoManifest) {
+		if cm.Key != "" {
+			return errors.New("this snapshot was made by an older version of subsys, so it has no signature to check against the student's key")
+		}
+		fmt.Println("Warning: this snapshot was made by an older version of subsys and can't be verified")
+	} else if err != nil {
+		return err
+	} else {
+		cm.manifest = &manifest
+		fmt.Println(manifest)
+		fmt.Printf("Verified %d file(s) against the snapshot manifest\n", len(manifest.Files))
+
+		err = cm.checkSigner(manifest)
+		if err != nil {
+			return err
+		}
+
+		if len(manifest.AllowedSecrets) > 0 {
+			fmt.Printf("Warning: the student allowed %d possible secret(s) into this snapshot:\n", len(manifest.AllowedSecrets))
+			for _, finding := range manifest.AllowedSecrets {
+				fmt.Printf("  %s\n", finding)
+			}
+		}
+	}
+
+	err = format.Walk(body, func(entry dirsnap.ArchiveEntry, contents io.Reader) error {
+		if !safePath(entry.Name) {
+			return fmt.Errorf("the archive contains %s, which is outside of the snapshot", entry.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
 	dirName := "Submission-" + cm.SubmissionID + "-snap-" + cm.SnapshotID
 
 	err = os.MkdirAll(dirName, 0777)
@@ -138,47 +272,204 @@ func (cm *CloneManager) DownloadSnapshot() error {
 		return err
 	}
 
-	reader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	// Links are created last so no file is ever written through one
+	links := map[string]string{}
+	err = format.Walk(body, func(entry dirsnap.ArchiveEntry, contents io.Reader) error {
+		if entry.Name == dirsnap.ManifestName || entry.Name == dirsnap.SignatureName {
+			return nil
+		}
+
+		if entry.Mode&os.ModeSymlink != 0 {
+			target, err := io.ReadAll(contents)
+			links[entry.Name] = string(target)
+			return err
+		}
+
+		return extractFile(entry, contents)
+	})
 	if err != nil {
 		fmt.Println(err)
 		return err
 	}
 
-	for _, file := range reader.File {
-		filePath := filepath.Join(".", file.Name)
+	safeLinks(links)
+	names := make([]string, 0, len(links))
+	for name := range links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-		err = os.MkdirAll(filepath.Dir(filePath), 0777)
+	for _, name := range names {
+		err = extractLink(name, links[name])
 		if err != nil {
 			fmt.Println(err)
 			return err
 		}
+	}
 
-		if file.FileInfo().IsDir() {
-			continue
+	cm.success = true
+	fmt.Printf("Snapshot downloaded and extracted successfully to %v\n", dirName)
+	return nil
+}
+
+// safePath reports whether an archive entry stays inside the directory it is
+// extracted to.
+func safePath(name string) bool {
+	name = strings.TrimSuffix(name, "/")
+	if name == "" || filepath.IsAbs(name) || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return false
+	}
+
+	clean := path.Clean(name)
+	return clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// insideDirectory makes sure dir, once any links in it are followed, is still
+// in the working directory the snapshot is extracted to. The directory may
+// have been left by an earlier clone, with links of its own.
+func insideDirectory(dir string) error {
+	root, err := filepath.EvalSymlinks(".")
+	if err != nil {
+		return err
+	}
+
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+
+	relative, err := filepath.Rel(root, resolved)
+	if err != nil || !filepath.IsLocal(relative) {
+		return fmt.Errorf("%s leads outside of the snapshot", filepath.ToSlash(dir))
+	}
+	return nil
+}
+
+func extractFile(entry dirsnap.ArchiveEntry, contents io.Reader) error {
+	filePath := filepath.FromSlash(entry.Name)
+
+	if entry.Mode.IsDir() {
+		return os.MkdirAll(filePath, 0777)
+	}
+
+	err := os.MkdirAll(filepath.Dir(filePath), 0777)
+	if err != nil {
+		return err
+	}
+
+	err = insideDirectory(filepath.Dir(filePath))
+	if err != nil {
+		return err
+	}
+
+	outFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	_, err = io.Copy(outFile, contents)
+	if err != nil {
+		return err
+	}
+
+	// The mode given when creating a file is limited by the umask
+	return outFile.Chmod(entry.Mode.Perm())
+}
+
+// safeLinks drops the links that point outside of the snapshot, since
+// following them would reach the lecturer's files. Links are followed the way
+// the system will once they're all extracted, so one can't escape through
+// another, like a link to y/.. where y is a link to the snapshot itself.
+// Dropping a link changes where the links through it lead, so they are
+// checked again until none are dropped.
+func safeLinks(links map[string]string) {
+	// A snapshot never has anything inside a link, and a link inside another
+	// would be made wherever that one leads
+	nested := map[string]string{}
+	for name := range links {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, isLink := links[dir]; isLink {
+				nested[name] = dir
+				break
+			}
 		}
+	}
+	for name, dir := range nested {
+		fmt.Printf("Warning: skipping %s, a link inside the link %s\n", name, dir)
+		delete(links, name)
+	}
 
-		outFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
-		if err != nil {
-			fmt.Println(err)
-			return err
+	for dropped := true; dropped; {
+		dropped = false
+		for name, target := range links {
+			if !path.IsAbs(target) && staysInside(name, links) {
+				continue
+			}
+
+			fmt.Printf("Warning: skipping %s, a link to %s which is outside of the snapshot\n", name, target)
+			delete(links, name)
+			dropped = true
 		}
-		defer outFile.Close()
+	}
+}
 
-		rc, err := file.Open()
-		if err != nil {
-			fmt.Println(err)
-			return err
+// maxLinkHops is how many links staysInside follows before giving up on a
+// path, like the system does for links that point at each other.
+const maxLinkHops = 40
+
+// staysInside reports whether a path in the snapshot, with the links in it
+// followed, stays inside the snapshot.
+func staysInside(name string, links map[string]string) bool {
+	resolved := "."
+	pending := strings.Split(name, "/")
+	for hops := 0; len(pending) > 0; {
+		part := pending[0]
+		pending = pending[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if resolved == "." {
+				return false
+			}
+			resolved = path.Dir(resolved)
+			continue
 		}
-		defer rc.Close()
 
-		_, err = io.Copy(outFile, rc)
-		if err != nil {
-			fmt.Println(err)
-			return err
+		next := path.Join(resolved, part)
+		target, isLink := links[next]
+		if !isLink {
+			resolved = next
+			continue
+		}
+
+		hops++
+		if hops > maxLinkHops || path.IsAbs(target) {
+			return false
 		}
+
+		// The target is relative to the directory the link is in
+		pending = append(strings.Split(target, "/"), pending...)
 	}
 
-	cm.success = true
-	fmt.Printf("Snapshot downloaded and extracted successfully to %v\n", dirName)
-	return nil
+	return true
+}
+
+// extractLink recreates a symbolic link that safeLinks kept.
+func extractLink(name string, target string) error {
+	linkPath := filepath.FromSlash(name)
+	err := os.MkdirAll(filepath.Dir(linkPath), 0777)
+	if err != nil {
+		return err
+	}
+
+	err = insideDirectory(filepath.Dir(linkPath))
+	if err != nil {
+		return err
+	}
+
+	os.Remove(linkPath)
+	return os.Symlink(target, linkPath)
 }
@@ -2,12 +2,22 @@ package dirclone
 
 import (
 	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
+
+	dirinit "amalitech.org/subsys/cmd/dir_init"
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+	"amalitech.org/subsys/utils"
 )
 
 func SetupCloneTests(t *testing.T) CloneManager {
@@ -164,6 +174,88 @@ func TestDownloadFail(t *testing.T) {
 
 }
 
+func TestDownloadVerifiesManifest(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		contents string
+		wantErr  bool
+	}{
+		{"untouched", "print('hello')", false},
+		{"tampered", "print('altered')", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cm := SetupCloneTests(t)
+
+			archive, err := createManifestZip("print('hello')", test.contents)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/zip")
+				w.WriteHeader(http.StatusOK)
+				w.Write(archive)
+			}))
+			defer server.Close()
+			cm.ServerUrl = server.URL
+
+			err = cm.DownloadSnapshot()
+			if test.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "altered: main.py") {
+					t.Fatalf("Expected the altered file to be reported, got %v", err)
+				}
+
+				if _, err := os.Stat("Submission-4-snap-1"); !os.IsNotExist(err) {
+					t.Errorf("Expected nothing to be extracted from a tampered archive")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+
+			data, err := os.ReadFile("main.py")
+			if err != nil || string(data) != test.contents {
+				t.Errorf("Expected main.py to be extracted, got %q (%v)", data, err)
+			}
+
+			if _, err := os.Stat(dirsnap.ManifestName); !os.IsNotExist(err) {
+				t.Errorf("Expected the manifest not to be extracted")
+			}
+		})
+	}
+}
+
+// createManifestZip builds an archive whose manifest describes manifestContents
+// as main.py, while the archive actually holds contents.
+func createManifestZip(manifestContents, contents string) ([]byte, error) {
+	hash := sha256.Sum256([]byte(manifestContents))
+	manifest, err := json.Marshal(dirsnap.ArchiveManifest{
+		Snapshot:      "first",
+		Assignment:    utils.AssignmentConfig{ProjectName: "project", StudentID: "9876", AssignmentCode: "12345"},
+		CreatedAt:     time.Now(),
+		SubsysVersion: utils.Version,
+		Files:         []dirsnap.ManifestFile{{Path: "main.py", SHA256: hex.EncodeToString(hash[:]), Size: int64(len(manifestContents))}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for name, data := range map[string]string{dirsnap.ManifestName: string(manifest), "main.py": contents} {
+		file, err := zipWriter.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		file.Write([]byte(data))
+	}
+
+	err = zipWriter.Close()
+	return buf.Bytes(), err
+}
+
 func createTestZip() error {
 	zipFile, err := os.Create("test.zip")
 	if err != nil {
@@ -186,3 +278,314 @@ func createTestZip() error {
 
 	return nil
 }
+
+func TestDownloadLinksModesAndEmptyDirs(t *testing.T) {
+	cm := SetupCloneTests(t)
+
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	add := func(name string, mode os.FileMode, contents string) {
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		header.SetMode(mode)
+		entry, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.Write([]byte(contents))
+	}
+	add("start.sh", os.ModeSymlink|0777, "bin/run.sh")
+	add("bin/run.sh", 0755, "#!/bin/sh\n")
+	add("assets/empty/", os.ModeDir|0755, "")
+	add("escape", os.ModeSymlink|0777, "../../outside")
+	zipWriter.Close()
+	archive := buf.Bytes()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write(archive)
+	}))
+	defer server.Close()
+	cm.ServerUrl = server.URL
+
+	err := cm.DownloadSnapshot()
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	target, err := os.Readlink("start.sh")
+	if err != nil || target != "bin/run.sh" {
+		t.Errorf("Expected start.sh to link to bin/run.sh, got %q (%v)", target, err)
+	}
+
+	info, err := os.Stat("bin/run.sh")
+	if err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("Expected bin/run.sh to be executable, got %v (%v)", info, err)
+	}
+
+	info, err = os.Stat("assets/empty")
+	if err != nil || !info.IsDir() {
+		t.Errorf("Expected assets/empty to be created, got %v", err)
+	}
+
+	if _, err := os.Lstat("escape"); !os.IsNotExist(err) {
+		t.Errorf("Expected the link pointing outside of the snapshot to be skipped")
+	}
+}
+
+func TestDownloadRejectsChainedLinks(t *testing.T) {
+	cm := SetupCloneTests(t)
+
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for name, target := range map[string]string{
+		"here":        ".",
+		"up":          "here/..",
+		"here/escape": "..",
+		"loop":        "loop",
+		"docs":        "here/README",
+	} {
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		header.SetMode(os.ModeSymlink | 0777)
+		entry, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.Write([]byte(target))
+	}
+	zipWriter.Close()
+	archive := buf.Bytes()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write(archive)
+	}))
+	defer server.Close()
+	cm.ServerUrl = server.URL
+
+	err := cm.DownloadSnapshot()
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	// Each of these only looks like it stays inside until the links in its
+	// path are followed
+	for _, name := range []string{"up", "escape", "loop"} {
+		if _, err := os.Lstat(name); !os.IsNotExist(err) {
+			t.Errorf("Expected the link %s to be skipped", name)
+		}
+	}
+
+	for name, expected := range map[string]string{"here": ".", "docs": "here/README"} {
+		target, err := os.Readlink(name)
+		if err != nil || target != expected {
+			t.Errorf("Expected %s to link to %s, got %q (%v)", name, expected, target, err)
+		}
+	}
+}
+
+func TestDownloadRejectsUnsafePaths(t *testing.T) {
+	cm := SetupCloneTests(t)
+
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	entry, _ := zipWriter.Create("../evil.txt")
+	entry.Write([]byte("evil"))
+	zipWriter.Close()
+	archive := buf.Bytes()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write(archive)
+	}))
+	defer server.Close()
+	cm.ServerUrl = server.URL
+
+	err := cm.DownloadSnapshot()
+	if err == nil {
+		t.Fatalf("Expected an archive escaping its directory to be rejected")
+	}
+
+	if _, err := os.Stat("evil.txt"); !os.IsNotExist(err) {
+		t.Errorf("Expected evil.txt not to be written")
+	}
+}
+
+func TestDownloadTarSnapshot(t *testing.T) {
+	cm := SetupCloneTests(t)
+
+	format, err := dirsnap.ArchiveFormatByName("tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	writer, err := format.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.WriteEntry(dirsnap.ArchiveEntry{Name: "bin/run.sh", Mode: 0755, Size: 10}, strings.NewReader("#!/bin/sh\n"))
+	writer.WriteEntry(dirsnap.ArchiveEntry{Name: "start.sh", Mode: os.ModeSymlink | 0777}, strings.NewReader("bin/run.sh"))
+	writer.Close()
+	archive := buf.Bytes()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write(archive)
+	}))
+	defer server.Close()
+	cm.ServerUrl = server.URL
+
+	err = cm.DownloadSnapshot()
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	info, err := os.Stat("bin/run.sh")
+	if err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("Expected bin/run.sh to be executable, got %v (%v)", info, err)
+	}
+
+	target, err := os.Readlink("start.sh")
+	if err != nil || target != "bin/run.sh" {
+		t.Errorf("Expected start.sh to link to bin/run.sh, got %q (%v)", target, err)
+	}
+}
+
+func TestDownloadEncryptedSnapshot(t *testing.T) {
+	cm := SetupCloneTests(t)
+
+	public, err := utils.GenerateIdentity("lecturer.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, _ := utils.DecodeRecipient(public)
+
+	archive, _ := os.ReadFile("test.zip")
+	sealed, err := utils.Encrypt(archive, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write(sealed)
+	}))
+	defer server.Close()
+	cm.ServerUrl = server.URL
+
+	cm.Identity = "missing.key"
+	err = cm.DownloadSnapshot()
+	if err == nil || !strings.Contains(err.Error(), "--identity") {
+		t.Fatalf("Expected an encrypted snapshot to need a private key, got %v", err)
+	}
+
+	utils.GenerateIdentity("other.key")
+	cm.Identity = "other.key"
+	err = cm.DownloadSnapshot()
+	if err == nil || !strings.Contains(err.Error(), "couldn't decrypt") {
+		t.Fatalf("Expected the wrong private key to be refused, got %v", err)
+	}
+
+	cm.Identity = "lecturer.key"
+	err = cm.DownloadSnapshot()
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	data, err := os.ReadFile("dummy.txt")
+	if err != nil || len(data) == 0 {
+		t.Errorf("Expected the decrypted snapshot to be extracted, got %q (%v)", data, err)
+	}
+}
+
+// createSignedArchive snaps main.py in a new subsys directory with its own
+// signing key, returning the archive and the key.
+func createSignedArchive(t *testing.T) ([]byte, string) {
+	working, _ := os.Getwd()
+	defer os.Chdir(working)
+
+	os.Chdir(t.TempDir())
+	initializer, err := dirinit.NewDirectoryInitializer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = initializer.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := utils.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	os.WriteFile("main.py", []byte("print('signed')"), 0644)
+	os.Args = []string{"program", "snap", "--name", "signed"}
+	err = dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	snapshot, err := dirsnap.LoadSnapshot("signed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	err = snapshot.WriteArchive(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return archive.Bytes(), utils.EncodePublicKey(key)
+}
+
+func TestDownloadChecksSigner(t *testing.T) {
+	signed, key := createSignedArchive(t)
+	_, other := createSignedArchive(t)
+	unsigned, err := createManifestZip("print('hello')", "print('hello')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		archive []byte
+		key     string
+		wantErr string
+	}{
+		{"registered key", signed, key, ""},
+		{"no key given", signed, "", ""},
+		{"another key", signed, other, "not the expected"},
+		{"unsigned", unsigned, key, "isn't signed"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cm := SetupCloneTests(t)
+			cm.Key = test.key
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				w.Write(test.archive)
+			}))
+			defer server.Close()
+			cm.ServerUrl = server.URL
+
+			err := cm.DownloadSnapshot()
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Expected no error but got %v", err)
+				}
+				if _, err := os.Stat(dirsnap.SignatureName); !os.IsNotExist(err) {
+					t.Errorf("Expected the signature not to be extracted")
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("Expected an error about %q, got %v", test.wantErr, err)
+			}
+			if _, err := os.Stat("Submission-4-snap-1"); !os.IsNotExist(err) {
+				t.Errorf("Expected nothing to be extracted from a snapshot with the wrong signer")
+			}
+		})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
 	"amalitech.org/subsys/utils"
 )
 
@@ -17,6 +18,8 @@ type Configurator struct {
 	Override    bool
 	AssCode     string
 	StudentID   string
+	Format      string
+	LecturerKey string
 	Data        utils.AssignmentConfig
 }
 
@@ -30,8 +33,12 @@ func NewConfigurator() *Configurator {
 	}
 
 	configData := utils.AssignmentConfig{
-		ProjectName: config.ProjectName,
-		Directory:   config.Directory,
+		ProjectName:    config.ProjectName,
+		Directory:      config.Directory,
+		HonorGitignore: config.HonorGitignore,
+		ArchiveFormat:  config.ArchiveFormat,
+		PublicKey:      config.PublicKey,
+		LecturerKey:    config.LecturerKey,
 	}
 
 	if config.AssignmentCode != "" || config.StudentID != "" {
@@ -55,6 +62,8 @@ func (c *Configurator) ConfigureDirectory() error {
 	flags.BoolVar(&c.Interactive, "I", false, "Interactive")
 	flags.StringVar(&c.AssCode, "code", "", "Quiz code")
 	flags.StringVar(&c.StudentID, "student_id", "", "Student ID")
+	flags.StringVar(&c.Format, "format", "", "Archive format snapshots are submitted in")
+	flags.StringVar(&c.LecturerKey, "lecturer-key", "", "Lecturer's public key to encrypt submissions to")
 	flags.Parse(os.Args[2:])
 
 	if c.Interactive {
@@ -98,9 +107,25 @@ func (c *Configurator) writeToConfigFile() error {
 	c.Data.AssignmentCode = c.AssCode
 	c.Data.StudentID = c.StudentID
 
+	if c.Format != "" {
+		_, err := dirsnap.ArchiveFormatByName(c.Format)
+		if err != nil {
+			return err
+		}
+		c.Data.ArchiveFormat = c.Format
+	}
+
+	if c.LecturerKey != "" {
+		_, err := utils.DecodeRecipient(c.LecturerKey)
+		if err != nil {
+			return err
+		}
+		c.Data.LecturerKey = c.LecturerKey
+	}
+
 	newFile, _ := json.MarshalIndent(c.Data, "", "")
 
-	err := os.WriteFile(filepath.Join(".subsys", "config.json"), newFile, 0666)
+	err := utils.WriteFileAtomic(filepath.Join(".subsys", "config.json"), newFile, 0666)
 
 	if err != nil {
 		return err
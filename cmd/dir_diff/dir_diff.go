@@ -0,0 +1,287 @@
+package dirdiff
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+	"amalitech.org/subsys/utils"
+)
+
+type DiffManager struct {
+	Config   utils.AssignmentConfig
+	Stat     bool
+	NameOnly bool
+	From     string
+	To       string
+	Output   io.Writer
+}
+
+// tree is one side of a diff, either a snapshot or the working tree.
+type tree struct {
+	working bool
+	files   map[string]dirsnap.SnapshotFile
+}
+
+type fileDiff struct {
+	change dirsnap.FileChange
+	lines  []utils.DiffLine
+}
+
+func NewDiffManager() *DiffManager {
+	config, err := utils.GetConfig()
+	if err != nil {
+		log.Fatalf("Couldn't get config file: %v \n", err)
+		return nil
+	}
+
+	return &DiffManager{
+		Config: config,
+		Output: os.Stdout,
+	}
+}
+
+func (dm *DiffManager) ShowDiff() error {
+	err := dm.parseArgs(os.Args[2:])
+	if err != nil {
+		return err
+	}
+
+	from, err := dm.loadTree(dm.From)
+	if err != nil {
+		return err
+	}
+
+	to, err := dm.loadTree(dm.To)
+	if err != nil {
+		return err
+	}
+
+	diffs, err := dm.diffTrees(from, to)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case dm.NameOnly:
+		for _, diff := range diffs {
+			fmt.Fprintln(dm.Output, diff.change.Path)
+		}
+	case dm.Stat:
+		dm.printStat(diffs)
+	default:
+		for _, diff := range diffs {
+			dm.printPatch(from, to, diff)
+		}
+	}
+
+	return nil
+}
+
+// parseArgs picks what to compare. With no snapshot the latest one is compared to the working tree, with one
+// that snapshot is compared to the working tree, and with two they are
+// compared to each other.
+func (dm *DiffManager) parseArgs(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	flags.BoolVar(&dm.Stat, "stat", false, "Show a summary of changed files")
+	flags.BoolVar(&dm.NameOnly, "name-only", false, "Show only the names of changed files")
+
+	snapshots, err := utils.ParseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+
+	switch len(snapshots) {
+	case 0:
+		latest, err := dirsnap.LatestSnapshot()
+		if err != nil {
+			return err
+		}
+		if latest == "" {
+			return errors.New("you have no snapshots yet, first create a snapshot with the subsys snap command")
+		}
+		dm.From = latest
+	case 1:
+		dm.From = snapshots[0]
+	case 2:
+		dm.From, dm.To = snapshots[0], snapshots[1]
+	default:
+		return errors.New("diff compares at most two snapshots")
+	}
+
+	return nil
+}
+
+// loadTree loads a snapshot's file list, or the working tree's when name is empty.
+func (dm *DiffManager) loadTree(name string) (tree, error) {
+	t := tree{files: map[string]dirsnap.SnapshotFile{}}
+
+	var files []dirsnap.SnapshotFile
+	if name == "" {
+		t.working = true
+		scanned, err := dirsnap.ScanFiles(".")
+		if err != nil {
+			return tree{}, err
+		}
+		files = scanned
+	} else {
+		snapshot, err := dirsnap.LoadSnapshot(name)
+		if err != nil {
+			return tree{}, err
+		}
+		files = snapshot.Files
+	}
+
+	for _, file := range files {
+		t.files[file.Path] = file
+	}
+
+	return t, nil
+}
+
+func (t tree) read(path string) ([]byte, error) {
+	file, ok := t.files[path]
+	if !ok {
+		return []byte{}, nil
+	}
+
+	if t.working && file.Mode&os.ModeSymlink != 0 {
+		target, err := os.Readlink(file.Path)
+		return []byte(target), err
+	}
+
+	if t.working {
+		return os.ReadFile(file.Path)
+	}
+
+	object, err := utils.ReadObject(file.Hash)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	return io.ReadAll(object)
+}
+
+func (t tree) contents() dirsnap.TreeContents {
+	hashes := make(map[string]string, len(t.files))
+	for path, file := range t.files {
+		hashes[path] = file.Hash
+	}
+
+	return dirsnap.TreeContents{Hashes: hashes, Read: t.read}
+}
+
+func (dm *DiffManager) diffTrees(from tree, to tree) ([]fileDiff, error) {
+	changes := make([]dirsnap.FileChange, 0)
+
+	for path, file := range from.files {
+		current, ok := to.files[path]
+		if !ok {
+			changes = append(changes, dirsnap.FileChange{Path: path, Status: dirsnap.Deleted})
+		} else if current.Hash != file.Hash || dirsnap.ModeChanged(file.Mode, current.Mode) {
+			changes = append(changes, dirsnap.FileChange{Path: path, Status: dirsnap.Modified})
+		}
+	}
+
+	for path := range to.files {
+		if _, ok := from.files[path]; !ok {
+			changes = append(changes, dirsnap.FileChange{Path: path, Status: dirsnap.Added})
+		}
+	}
+
+	changes = dirsnap.DetectRenames(changes, from.contents(), to.contents())
+
+	diffs := make([]fileDiff, 0, len(changes))
+	for _, change := range changes {
+		diff := fileDiff{change: change}
+
+		if !dm.NameOnly {
+			source := change.Path
+			if change.From != "" {
+				source = change.From
+			}
+
+			before, err := from.read(source)
+			if err != nil {
+				return nil, err
+			}
+
+			after, err := to.read(change.Path)
+			if err != nil {
+				return nil, err
+			}
+
+			if utils.IsBinary(before) || utils.IsBinary(after) {
+				diff.change.Binary = true
+			} else {
+				diff.lines = utils.DiffLines(utils.SplitLines(string(before)), utils.SplitLines(string(after)))
+				diff.change.Insertions, diff.change.Deletions = utils.DiffStat(diff.lines)
+			}
+		}
+
+		diffs = append(diffs, diff)
+	}
+
+	return diffs, nil
+}
+
+func (dm *DiffManager) printPatch(from tree, to tree, diff fileDiff) {
+	path := diff.change.Path
+	oldPath := path
+	if diff.change.From != "" {
+		oldPath = diff.change.From
+	}
+	oldName, newName := "a/"+oldPath, "b/"+path
+
+	fmt.Fprintf(dm.Output, "diff --subsys a/%s b/%s\n", oldPath, path)
+	switch diff.change.Status {
+	case dirsnap.Renamed, dirsnap.Copied:
+		verb := "rename"
+		if diff.change.Status == dirsnap.Copied {
+			verb = "copy"
+		}
+		fmt.Fprintf(dm.Output, "similarity index %d%%\n%s from %s\n%s to %s\n", diff.change.Similarity, verb, oldPath, verb, path)
+
+		// An exact rename or copy has no content changes to show
+		if diff.change.Similarity == 100 {
+			return
+		}
+	case dirsnap.Added:
+		fmt.Fprintf(dm.Output, "new file mode %o\n", to.files[path].Mode.Perm())
+		oldName = "/dev/null"
+	case dirsnap.Deleted:
+		fmt.Fprintf(dm.Output, "deleted file mode %o\n", from.files[path].Mode.Perm())
+		newName = "/dev/null"
+	case dirsnap.Modified:
+		oldMode, newMode := from.files[path].Mode, to.files[path].Mode
+		if dirsnap.ModeChanged(oldMode, newMode) {
+			fmt.Fprintf(dm.Output, "old mode %s\nnew mode %s\n", oldMode, newMode)
+		}
+
+		if from.files[path].Hash == to.files[path].Hash {
+			return
+		}
+	}
+
+	if diff.change.Binary {
+		fmt.Fprintf(dm.Output, "Binary files %s and %s differ\n", oldName, newName)
+		return
+	}
+
+	fmt.Fprintf(dm.Output, "--- %s\n+++ %s\n", oldName, newName)
+	fmt.Fprint(dm.Output, utils.UnifiedHunks(diff.lines, 3))
+}
+
+func (dm *DiffManager) printStat(diffs []fileDiff) {
+	changes := make([]dirsnap.FileChange, 0, len(diffs))
+	for _, diff := range diffs {
+		changes = append(changes, diff.change)
+	}
+
+	dirsnap.WriteStat(dm.Output, changes)
+}
@@ -0,0 +1,167 @@
+package dirdiff
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	dirinit "amalitech.org/subsys/cmd/dir_init"
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+)
+
+func SetupDiffTests(t *testing.T) *DiffManager {
+	tempDir := t.TempDir()
+
+	err := os.Chdir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to change working directory: %v", err)
+	}
+
+	initializer, err := dirinit.NewDirectoryInitializer()
+	if err != nil {
+		t.Fatalf("NewDirectoryInitializer failed: %v", err)
+	}
+
+	err = initializer.Initialize()
+	if err != nil {
+		t.Fatalf("InitializeDirectory failed: %v", err)
+	}
+
+	os.WriteFile("main.py", []byte("a\nb\nc\n"), 0644)
+	os.WriteFile("old.txt", []byte("gone\n"), 0644)
+	os.WriteFile("image.bin", []byte{0, 1, 2}, 0644)
+	createSnapshot(t, "first")
+
+	os.WriteFile("main.py", []byte("a\nB\nc\nd\n"), 0644)
+	os.Remove("old.txt")
+	os.WriteFile("new.txt", []byte("hello\n"), 0644)
+	os.WriteFile("image.bin", []byte{0, 1, 3}, 0644)
+	createSnapshot(t, "second")
+
+	dm := NewDiffManager()
+	dm.Output = &bytes.Buffer{}
+	return dm
+}
+
+func createSnapshot(t *testing.T, name string) {
+	os.Args = []string{"program", "snap", "--name", name}
+	err := dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot %s: %v", name, err)
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	dm := SetupDiffTests(t)
+
+	os.Args = []string{"program", "diff", "first", "second"}
+	err := dm.ShowDiff()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	output := dm.Output.(*bytes.Buffer).String()
+	expected := []string{
+		"--- a/main.py\n+++ b/main.py\n@@ -1,3 +1,4 @@\n a\n-b\n+B\n c\n+d\n",
+		"--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1,1 @@\n+hello\n",
+		"--- a/old.txt\n+++ /dev/null\n@@ -1,1 +0,0 @@\n-gone\n",
+		"Binary files a/image.bin and b/image.bin differ",
+	}
+	for _, patch := range expected {
+		if !strings.Contains(output, patch) {
+			t.Errorf("Expected diff to contain:\n%s\nGot:\n%s", patch, output)
+		}
+	}
+}
+
+func TestDiffWorkingTree(t *testing.T) {
+	dm := SetupDiffTests(t)
+
+	os.WriteFile("main.py", []byte("a\nB\nc\nd\ne\n"), 0644)
+
+	os.Args = []string{"program", "diff", "--name-only"}
+	err := dm.ShowDiff()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	output := dm.Output.(*bytes.Buffer).String()
+	if output != "main.py\n" {
+		t.Errorf("Expected only main.py to differ from the latest snapshot, got:\n%s", output)
+	}
+}
+
+func TestDiffStat(t *testing.T) {
+	dm := SetupDiffTests(t)
+
+	os.Args = []string{"program", "diff", "first", "second", "--stat"}
+	err := dm.ShowDiff()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	output := dm.Output.(*bytes.Buffer).String()
+	for _, expected := range []string{
+		" image.bin | Bin\n",
+		" main.py   | 3 ++-\n",
+		" 4 file(s) changed, 3 insertion(s)(+), 2 deletion(s)(-)\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected stat to contain %q, got:\n%s", expected, output)
+		}
+	}
+}
+
+func TestDiffUnknownSnapshot(t *testing.T) {
+	dm := SetupDiffTests(t)
+
+	os.Args = []string{"program", "diff", "missing"}
+	err := dm.ShowDiff()
+	if err == nil {
+		t.Error("Expected an error for an unknown snapshot, but got none")
+	}
+}
+
+func TestDiffRenames(t *testing.T) {
+	dm := SetupDiffTests(t)
+
+	os.MkdirAll("src", 0777)
+	os.WriteFile("src/main.py", []byte("a\nB\nc\nd\ne\n"), 0644)
+	os.Remove("main.py")
+	os.Rename("image.bin", "picture.bin")
+	os.WriteFile("copy.txt", []byte("hello\n"), 0644)
+
+	os.Args = []string{"program", "diff"}
+	err := dm.ShowDiff()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	output := dm.Output.(*bytes.Buffer).String()
+	expected := []string{
+		"diff --subsys a/main.py b/src/main.py\nsimilarity index 80%\nrename from main.py\nrename to src/main.py\n--- a/main.py\n+++ b/src/main.py\n",
+		"diff --subsys a/image.bin b/picture.bin\nsimilarity index 100%\nrename from image.bin\nrename to picture.bin\n",
+		"diff --subsys a/new.txt b/copy.txt\nsimilarity index 100%\ncopy from new.txt\ncopy to copy.txt\n",
+	}
+	for _, want := range expected {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected diff to contain %q, got:\n%s", want, output)
+		}
+	}
+
+	if strings.Contains(output, "deleted file") || strings.Contains(output, "new file") {
+		t.Errorf("Expected no plain additions or deletions, got:\n%s", output)
+	}
+
+	dm.Output = &bytes.Buffer{}
+	os.Args = []string{"program", "diff", "--stat"}
+	err = dm.ShowDiff()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !strings.Contains(dm.Output.(*bytes.Buffer).String(), " main.py => src/main.py   | 1 +") {
+		t.Errorf("Expected the rename in the stat, got:\n%s", dm.Output.(*bytes.Buffer).String())
+	}
+}
@@ -2,17 +2,21 @@ package dirinit
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"amalitech.org/subsys/utils"
 )
 
 type configInitializer struct {
-	ProjectName string
-	Directory   string
+	ProjectName    string
+	Directory      string
+	Presets        []string
+	HonorGitignore bool
 }
 
 func NewDirectoryInitializer() (*configInitializer, error) {
@@ -29,6 +33,32 @@ func NewDirectoryInitializer() (*configInitializer, error) {
 	}, nil
 }
 
+func (si *configInitializer) ParseFlags(args []string) error {
+	var presets string
+
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	flags.StringVar(&presets, "preset", "", "Seed subsysignore for a language: "+strings.Join(presetNames(), ", "))
+	flags.BoolVar(&si.HonorGitignore, "honor-gitignore", false, "Also apply the patterns in .gitignore files")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if presets == "" {
+		return nil
+	}
+
+	for _, preset := range strings.Split(presets, ",") {
+		preset = strings.TrimSpace(preset)
+		if _, ok := ignorePresets[preset]; !ok {
+			return fmt.Errorf("unknown preset %s, valid presets are: %s", preset, strings.Join(presetNames(), ", "))
+		}
+		si.Presets = append(si.Presets, preset)
+	}
+
+	return nil
+}
+
 func (si *configInitializer) Initialize() error {
 	fmt.Printf("Initializing a new assignment in directory %v\n", si.Directory)
 	fmt.Printf("Project name: %v\n", si.ProjectName)
@@ -50,8 +80,9 @@ func (si *configInitializer) Initialize() error {
 	defer configFile.Close()
 
 	config := utils.AssignmentConfig{
-		ProjectName: si.ProjectName,
-		Directory:   si.Directory,
+		ProjectName:    si.ProjectName,
+		Directory:      si.Directory,
+		HonorGitignore: si.HonorGitignore,
 	}
 	encoder := json.NewEncoder(configFile)
 	err = encoder.Encode(config)
@@ -71,7 +102,12 @@ func (si *configInitializer) Initialize() error {
 	}
 	defer trackFile.Close()
 
-	_, writeErr := ignoreFile.WriteString("# This file contains files to ignore in your snapshots\n.subsys\nsubsysignore\n.git")
+	ignored := "# This file contains files to ignore in your snapshots\n.subsys\nsubsysignore\n.git"
+	for _, preset := range si.Presets {
+		ignored += fmt.Sprintf("\n\n# %s\n%s", preset, strings.Join(ignorePresets[preset], "\n"))
+	}
+
+	_, writeErr := ignoreFile.WriteString(ignored)
 	if writeErr != nil {
 		return writeErr
 	}
@@ -3,6 +3,7 @@ package dirinit
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -64,3 +65,56 @@ func TestInitialize(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestInitializeWithPreset(t *testing.T) {
+	tempDir := t.TempDir()
+
+	err := os.Chdir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to change working directory: %v", err)
+	}
+
+	initializer := configInitializer{
+		ProjectName: "test_project",
+		Directory:   tempDir,
+	}
+
+	err = initializer.ParseFlags([]string{"--preset", "node,python", "--honor-gitignore"})
+	if err != nil {
+		t.Fatalf("Unexpected error parsing flags: %v", err)
+	}
+
+	err = initializer.Initialize()
+	if err != nil {
+		t.Fatalf("Error initializing submission: %v", err)
+	}
+
+	ignoreFile, err := os.ReadFile("subsysignore")
+	if err != nil {
+		t.Fatalf("Error reading ignore file: %v", err)
+	}
+
+	for _, expected := range []string{".subsys", "node_modules/", "__pycache__/", "venv/"} {
+		if !strings.Contains(string(ignoreFile), expected+"\n") && !strings.HasSuffix(string(ignoreFile), expected) {
+			t.Errorf("Expected subsysignore to contain %s, got:\n%s", expected, ignoreFile)
+		}
+	}
+
+	configFile, err := os.ReadFile(filepath.Join(".subsys", "config.json"))
+	if err != nil {
+		t.Fatalf("Error reading config file: %v", err)
+	}
+
+	if !strings.Contains(string(configFile), `"HonorGitignore":true`) {
+		t.Errorf("Expected config to honor .gitignore, got %s", configFile)
+	}
+}
+
+func TestParseFlagsUnknownPreset(t *testing.T) {
+	initializer := configInitializer{}
+
+	err := initializer.ParseFlags([]string{"--preset", "cobol"})
+	if err == nil {
+		t.Error("Expected an error for an unknown preset, but got none")
+	}
+}
@@ -0,0 +1,60 @@
+package dirinit
+
+import "sort"
+
+// ignorePresets are the build outputs, dependencies and caches that students
+// shouldn't snapshot for each language.
+var ignorePresets = map[string][]string{
+	"go": {
+		"*.exe",
+		"*.test",
+		"*.out",
+		"bin/",
+		"vendor/",
+	},
+	"python": {
+		"__pycache__/",
+		"*.py[cod]",
+		"venv/",
+		".venv/",
+		"env/",
+		"*.egg-info/",
+		".pytest_cache/",
+		".ipynb_checkpoints/",
+	},
+	"node": {
+		"node_modules/",
+		"dist/",
+		"build/",
+		".next/",
+		".npm/",
+		"npm-debug.log*",
+		"yarn-error.log*",
+	},
+	"java": {
+		"target/",
+		"build/",
+		"out/",
+		".gradle/",
+		"*.class",
+	},
+	"c": {
+		"*.o",
+		"*.obj",
+		"*.a",
+		"*.so",
+		"*.exe",
+		"*.out",
+		"build/",
+		"cmake-build-*/",
+	},
+}
+
+func presetNames() []string {
+	names := make([]string, 0, len(ignorePresets))
+	for name := range ignorePresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,142 @@
+package dirkeys
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"amalitech.org/subsys/utils"
+)
+
+type KeysManager struct {
+	Config utils.AssignmentConfig
+	Force  bool
+	Path   string
+	Output io.Writer
+}
+
+// NewKeysManager doesn't need a config, since lecturers make their keys
+// outside of any subsys directory.
+func NewKeysManager() *KeysManager {
+	config, _ := utils.GetConfig()
+
+	return &KeysManager{
+		Config: config,
+		Output: os.Stdout,
+	}
+}
+
+func (km *KeysManager) ManageKeys() error {
+	if len(os.Args) < 3 {
+		return errors.New("specify what to do: generate, show or lecturer")
+	}
+
+	flags := flag.NewFlagSet("keys "+os.Args[2], flag.ContinueOnError)
+	flags.BoolVar(&km.Force, "force", false, "Replace your existing key")
+	flags.StringVar(&km.Path, "output", utils.DefaultIdentityPath, "File to write the lecturer's private key to")
+
+	_, err := utils.ParseInterspersed(flags, os.Args[3:])
+	if err != nil {
+		return err
+	}
+	km.Path = utils.UserPath(km.Path)
+
+	switch os.Args[2] {
+	case "generate":
+		return km.Generate()
+	case "show":
+		return km.Show()
+	case "lecturer":
+		return km.Lecturer()
+	default:
+		return fmt.Errorf("unknown keys command %s, use generate, show or lecturer", os.Args[2])
+	}
+}
+
+// Generate creates a signing key and registers its public half with the
+// student ID in the config. Snapshots are signed with it from then on.
+func (km *KeysManager) Generate() error {
+	_, err := utils.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	if km.Config.StudentID == "" {
+		return errors.New("no Student ID found, first configure this directory so your key can be registered with it")
+	}
+
+	if _, err := os.Stat(utils.PrivateKeyPath()); err == nil && !km.Force {
+		return errors.New("you already have a signing key, use --force to replace it. Snapshots signed with the old key won't match the new one")
+	}
+
+	key, err := utils.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	km.Config.PublicKey = utils.EncodePublicKey(key)
+	data, err := json.MarshalIndent(km.Config, "", "")
+	if err != nil {
+		return err
+	}
+
+	err = utils.WriteFileAtomic(filepath.Join(".subsys", "config.json"), data, 0666)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(km.Output, "Generated signing key %s for student %s\n", utils.KeyFingerprint(key), km.Config.StudentID)
+	fmt.Fprintf(km.Output, "Your snapshots will be signed with it from now on. Public key: %s\n", km.Config.PublicKey)
+	return nil
+}
+
+// Show prints the registered public key, warning if the local key isn't its pair.
+func (km *KeysManager) Show() error {
+	if km.Config.PublicKey == "" {
+		return utils.ErrNoKey
+	}
+
+	public, err := utils.DecodePublicKey(km.Config.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(km.Output, "Student:     %s\n", km.Config.StudentID)
+	fmt.Fprintf(km.Output, "Public key:  %s\n", km.Config.PublicKey)
+	fmt.Fprintf(km.Output, "Fingerprint: %s\n", utils.KeyFingerprint(public))
+
+	private, err := utils.LoadPrivateKey()
+	if errors.Is(err, utils.ErrNoKey) {
+		fmt.Fprintln(km.Output, "Warning: the private key isn't on this machine, so snapshots made here won't be signed")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !public.Equal(private.Public()) {
+		fmt.Fprintln(km.Output, "Warning: your private key doesn't match the registered public key, generate a new one with --force")
+	}
+
+	return nil
+}
+
+// Lecturer creates the key pair a lecturer receives encrypted submissions
+// with. Students set the public key with subsys config --lecturer-key.
+func (km *KeysManager) Lecturer() error {
+	public, err := utils.GenerateIdentity(km.Path)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists, choose another file with --output", km.Path)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(km.Output, "Wrote your private key to %s, keep it safe as it's the only way to decrypt submissions\n", km.Path)
+	fmt.Fprintf(km.Output, "Give this public key to your students: %s\n", public)
+	return nil
+}
@@ -0,0 +1,160 @@
+package dirkeys
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dirinit "amalitech.org/subsys/cmd/dir_init"
+	"amalitech.org/subsys/utils"
+)
+
+func SetupKeysTests(t *testing.T) *KeysManager {
+	tempDir := t.TempDir()
+
+	err := os.Chdir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to change working directory: %v", err)
+	}
+
+	initializer, err := dirinit.NewDirectoryInitializer()
+	if err != nil {
+		t.Fatalf("NewDirectoryInitializer failed: %v", err)
+	}
+
+	err = initializer.Initialize()
+	if err != nil {
+		t.Fatalf("InitializeDirectory failed: %v", err)
+	}
+
+	config, _ := utils.GetConfig()
+	config.StudentID = "s123"
+	config.AssignmentCode = "CS101"
+	data, _ := json.Marshal(config)
+	os.WriteFile(filepath.Join(".subsys", "config.json"), data, 0666)
+
+	km := NewKeysManager()
+	km.Output = &bytes.Buffer{}
+	return km
+}
+
+func TestGenerate(t *testing.T) {
+	km := SetupKeysTests(t)
+
+	err := km.Generate()
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	info, err := os.Stat(utils.PrivateKeyPath())
+	if err != nil {
+		t.Fatalf("Expected a private key: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the private key to be private, got mode %v", info.Mode())
+	}
+
+	config, _ := utils.GetConfig()
+	if config.PublicKey == "" || config.StudentID != "s123" || config.AssignmentCode != "CS101" {
+		t.Fatalf("Expected the key to be registered in the config, got %+v", config)
+	}
+
+	private, err := utils.LoadPrivateKey()
+	if err != nil {
+		t.Fatalf("LoadPrivateKey failed: %v", err)
+	}
+	public, _ := utils.DecodePublicKey(config.PublicKey)
+	if !public.Equal(private.Public()) {
+		t.Errorf("Expected the registered key to match the private key")
+	}
+
+	err = km.Generate()
+	if err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Errorf("Expected an existing key not to be replaced without --force, got %v", err)
+	}
+
+	km.Force = true
+	err = km.Generate()
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	replaced, _ := utils.GetConfig()
+	if replaced.PublicKey == config.PublicKey {
+		t.Errorf("Expected --force to register a new key")
+	}
+}
+
+func TestGenerateNeedsStudentID(t *testing.T) {
+	km := SetupKeysTests(t)
+	km.Config.StudentID = ""
+
+	err := km.Generate()
+	if err == nil {
+		t.Errorf("Expected a key not to be generated without a student ID")
+	}
+}
+
+func TestShow(t *testing.T) {
+	km := SetupKeysTests(t)
+
+	err := km.Show()
+	if err != utils.ErrNoKey {
+		t.Errorf("Expected ErrNoKey, got %v", err)
+	}
+
+	km.Generate()
+	km.Output = &bytes.Buffer{}
+
+	err = km.Show()
+	if err != nil {
+		t.Fatalf("Show failed: %v", err)
+	}
+
+	output := km.Output.(*bytes.Buffer).String()
+	for _, expected := range []string{"Student:     s123", "Public key:  " + km.Config.PublicKey, "Fingerprint: SHA256:"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected %q in output, got:\n%s", expected, output)
+		}
+	}
+
+	os.Remove(utils.PrivateKeyPath())
+	km.Output = &bytes.Buffer{}
+	km.Show()
+	if !strings.Contains(km.Output.(*bytes.Buffer).String(), "isn't on this machine") {
+		t.Errorf("Expected a warning about the missing private key, got %s", km.Output.(*bytes.Buffer).String())
+	}
+}
+
+func TestLecturer(t *testing.T) {
+	km := SetupKeysTests(t)
+	km.Path = filepath.Join(t.TempDir(), "lecturer.key")
+
+	err := km.Lecturer()
+	if err != nil {
+		t.Fatalf("Lecturer failed: %v", err)
+	}
+
+	output := km.Output.(*bytes.Buffer).String()
+	public := strings.TrimSpace(output[strings.LastIndex(output, ": ")+2:])
+	recipient, err := utils.DecodeRecipient(public)
+	if err != nil {
+		t.Fatalf("Expected a public key to share, got %q: %v", output, err)
+	}
+
+	key, err := utils.LoadIdentity(km.Path)
+	if err != nil {
+		t.Fatalf("LoadIdentity failed: %v", err)
+	}
+	if !key.PublicKey().Equal(recipient) {
+		t.Errorf("Expected the shared key to match the private key")
+	}
+
+	err = km.Lecturer()
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("Expected an existing key not to be overwritten, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package dirlog
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+	"amalitech.org/subsys/utils"
+)
+
+type LogManager struct {
+	Config utils.AssignmentConfig
+	JSON   bool
+	Output io.Writer
+}
+
+func NewLogManager() *LogManager {
+	config, err := utils.GetConfig()
+	if err != nil {
+		log.Fatalf("Couldn't get config file: %v \n", err)
+		return nil
+	}
+
+	return &LogManager{
+		Config: config,
+		Output: os.Stdout,
+	}
+}
+
+func (lm *LogManager) ShowLog() error {
+	flags := flag.NewFlagSet("log", flag.ContinueOnError)
+	flags.BoolVar(&lm.JSON, "json", false, "Print the history as JSON")
+	flags.Parse(os.Args[2:])
+
+	snapshots, err := dirsnap.ListSnapshots()
+	if err != nil {
+		return err
+	}
+
+	// Newest first, like git log
+	history := make([]dirsnap.Snapshot, 0, len(snapshots))
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snapshot := snapshots[i]
+		snapshot.Files = nil
+		history = append(history, snapshot)
+	}
+
+	if lm.JSON {
+		encoder := json.NewEncoder(lm.Output)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(history)
+	}
+
+	if len(history) == 0 {
+		fmt.Fprintln(lm.Output, "You have no snapshots yet, first create a snapshot with the subsys snap command")
+		return nil
+	}
+
+	for _, snapshot := range history {
+		lm.printSnapshot(snapshot)
+	}
+
+	return nil
+}
+
+func (lm *LogManager) printSnapshot(snapshot dirsnap.Snapshot) {
+	fmt.Fprintf(lm.Output, "snapshot %s\n", snapshot.Name)
+	if snapshot.Parent != "" {
+		fmt.Fprintf(lm.Output, "Parent: %s\n", snapshot.Parent)
+	}
+	fmt.Fprintf(lm.Output, "Date:   %s\n", snapshot.CreatedAt.Local().Format("Mon Jan 2 15:04:05 2006 -0700"))
+	fmt.Fprintf(lm.Output, "Files:  %d (%s)\n", snapshot.FileCount, utils.FormatSize(snapshot.Size))
+
+	if snapshot.Message != "" {
+		fmt.Fprintf(lm.Output, "\n    %s\n", snapshot.Message)
+	}
+
+	if len(snapshot.Changes) > 0 {
+		fmt.Fprintln(lm.Output)
+		insertions, deletions := 0, 0
+		for _, change := range snapshot.Changes {
+			insertions += change.Insertions
+			deletions += change.Deletions
+
+			if stat := change.LineStat(); stat != "" {
+				fmt.Fprintf(lm.Output, "    %s (%s)\n", change, stat)
+			} else {
+				fmt.Fprintf(lm.Output, "    %s\n", change)
+			}
+		}
+		fmt.Fprintf(lm.Output, "    %d file(s) changed, %d insertion(s)(+), %d deletion(s)(-)\n", len(snapshot.Changes), insertions, deletions)
+	}
+
+	fmt.Fprintln(lm.Output)
+}
@@ -0,0 +1,99 @@
+package dirlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	dirinit "amalitech.org/subsys/cmd/dir_init"
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+)
+
+func SetupLogTests(t *testing.T) *LogManager {
+	tempDir := t.TempDir()
+
+	err := os.Chdir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to change working directory: %v", err)
+	}
+
+	initializer, err := dirinit.NewDirectoryInitializer()
+	if err != nil {
+		t.Fatalf("NewDirectoryInitializer failed: %v", err)
+	}
+
+	err = initializer.Initialize()
+	if err != nil {
+		t.Fatalf("InitializeDirectory failed: %v", err)
+	}
+
+	os.WriteFile("main.py", []byte("print('hello')"), 0644)
+	os.Args = []string{"program", "snap", "--name", "first", "--message", "initial work"}
+	err = dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	os.WriteFile("main.py", []byte("print('hello world')"), 0644)
+	os.Args = []string{"program", "snap", "--name", "second"}
+	err = dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	lm := NewLogManager()
+	lm.Output = &bytes.Buffer{}
+	return lm
+}
+
+func TestShowLog(t *testing.T) {
+	lm := SetupLogTests(t)
+
+	os.Args = []string{"program", "log"}
+	err := lm.ShowLog()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	output := lm.Output.(*bytes.Buffer).String()
+
+	if strings.Index(output, "snapshot second") > strings.Index(output, "snapshot first") {
+		t.Errorf("Expected newest snapshot first, got:\n%s", output)
+	}
+
+	for _, expected := range []string{"Parent: first", "initial work", "Modified: main.py (+1 -1)", "1 file(s) changed, 1 insertion(s)(+), 1 deletion(s)(-)"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected log to contain %q, got:\n%s", expected, output)
+		}
+	}
+}
+
+func TestShowLogJSON(t *testing.T) {
+	lm := SetupLogTests(t)
+
+	os.Args = []string{"program", "log", "--json"}
+	err := lm.ShowLog()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var history []dirsnap.Snapshot
+	err = json.Unmarshal(lm.Output.(*bytes.Buffer).Bytes(), &history)
+	if err != nil {
+		t.Fatalf("Expected valid JSON output: %v", err)
+	}
+
+	if len(history) != 2 {
+		t.Fatalf("Expected 2 snapshots in history, got %v", len(history))
+	}
+
+	if history[0].Name != "second" || history[0].Parent != "first" {
+		t.Errorf("Unexpected history entry: %+v", history[0])
+	}
+
+	if len(history[0].Changes) != 1 || history[0].Changes[0].Status != dirsnap.Modified {
+		t.Errorf("Expected a single modification, got %+v", history[0].Changes)
+	}
+}
@@ -0,0 +1,337 @@
+package dirrestore
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+	"amalitech.org/subsys/utils"
+)
+
+type RestoreManager struct {
+	Config       utils.AssignmentConfig
+	SnapshotName string
+	Paths        []string
+	Force        bool
+}
+
+func NewRestoreManager() *RestoreManager {
+	config, err := utils.GetConfig()
+	if err != nil {
+		log.Fatalf("Couldn't get config file: %v \n", err)
+		return nil
+	}
+
+	return &RestoreManager{
+		Config: config,
+	}
+}
+
+func (rm *RestoreManager) RestoreSnapshot() error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.StringVar(&rm.SnapshotName, "name", "", "Name of the snapshot to restore")
+	flags.BoolVar(&rm.Force, "force", false, "Overwrite changes that haven't been snapped")
+	paths, err := utils.ParseInterspersed(flags, os.Args[2:])
+	if err != nil {
+		return err
+	}
+
+	if rm.SnapshotName == "" {
+		return errors.New("specify the snapshot to restore with --name")
+	}
+
+	for _, path := range paths {
+		rm.Paths = append(rm.Paths, filepath.ToSlash(filepath.Clean(utils.UserPath(path))))
+	}
+
+	return rm.Restore()
+}
+
+// Restore brings the selected paths, or the whole tree, back to the state
+// they had in the snapshot. Ignored files are never touched.
+func (rm *RestoreManager) Restore() error {
+	snapshot, err := dirsnap.LoadSnapshot(rm.SnapshotName)
+	if err != nil {
+		return err
+	}
+
+	ignored, err := utils.LoadIgnoreMatcher(".")
+	if err != nil {
+		return err
+	}
+
+	for _, path := range rm.Paths {
+		if path == ".." || strings.HasPrefix(path, "../") || filepath.IsAbs(path) {
+			return fmt.Errorf("%s is outside of the subsys directory", path)
+		}
+	}
+
+	err = rm.checkPendingChanges()
+	if err != nil {
+		return err
+	}
+
+	current, err := dirsnap.ScanFiles(".")
+	if err != nil {
+		return err
+	}
+
+	currentFiles := map[string]dirsnap.SnapshotFile{}
+	for _, file := range current {
+		currentFiles[file.Path] = file
+	}
+
+	tracker, err := dirsnap.ReadTracker(".")
+	if err != nil {
+		return err
+	}
+
+	if tracker == nil {
+		tracker = dirsnap.NewTracker()
+	}
+
+	matched := map[string]bool{}
+	for _, file := range append(snapshot.Files, current...) {
+		rm.inScope(file.Path, matched)
+	}
+	for _, dir := range snapshot.EmptyDirs {
+		rm.inScope(dir, matched)
+	}
+
+	for _, path := range rm.Paths {
+		if !matched[path] {
+			return fmt.Errorf("%s did not match any file in snapshot %s or in your directory", path, rm.SnapshotName)
+		}
+	}
+
+	selected := map[string]bool{}
+	for _, file := range snapshot.Files {
+		if rm.inScope(file.Path, matched) && !ignored.Ignored(file.Path, false) {
+			selected[file.Path] = true
+		}
+	}
+
+	// Files are removed first, so a link or file in the way of a directory is
+	// gone before anything is written there
+	for _, file := range current {
+		if selected[file.Path] || !rm.inScope(file.Path, matched) {
+			continue
+		}
+
+		err = os.Remove(file.Path)
+		if err != nil {
+			return err
+		}
+		removeEmptyParents(file.Path)
+		delete(tracker.Files, file.Path)
+		fmt.Printf("Removed: %s\n", file.Path)
+	}
+
+	for _, file := range snapshot.Files {
+		if !selected[file.Path] {
+			continue
+		}
+
+		existing, ok := currentFiles[file.Path]
+		if !ok || existing.Hash != file.Hash || existing.Mode.Type() != file.Mode.Type() || existing.Mode.Perm() != file.Mode.Perm() {
+			err = restoreFile(file)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Restored: %s\n", file.Path)
+		}
+
+		info, err := os.Lstat(filepath.FromSlash(file.Path))
+		if err != nil {
+			return err
+		}
+
+		tracker.Files[file.Path] = dirsnap.TrackedFile{
+			Hash:    file.Hash,
+			CRC32:   file.CRC32,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Mode:    info.Mode(),
+		}
+	}
+
+	for _, dir := range snapshot.EmptyDirs {
+		if !rm.inScope(dir, matched) || ignored.Ignored(dir, true) {
+			continue
+		}
+
+		path, err := localPath(dir)
+		if err != nil {
+			return err
+		}
+
+		err = os.MkdirAll(path, 0777)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tracker.Save(".")
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Snapshot %s restored successfully\n", rm.SnapshotName)
+	return nil
+}
+
+// checkPendingChanges refuses to continue when files about to be restored
+// have changes that were never snapped, unless --force was given.
+func (rm *RestoreManager) checkPendingChanges() error {
+	if rm.Force {
+		return nil
+	}
+
+	sm := &dirsnap.SnapshotManager{Config: rm.Config}
+	changes, err := sm.PendingChanges(".")
+	if err != nil {
+		return err
+	}
+
+	pending := []string{}
+	for _, change := range changes {
+		inScope := rm.inScope(change.Path, map[string]bool{}) || (change.Status == dirsnap.Renamed && rm.inScope(change.From, map[string]bool{}))
+		if change.Path != "" && inScope {
+			pending = append(pending, change.String())
+		}
+	}
+
+	if len(pending) > 0 {
+		return fmt.Errorf("these changes haven't been snapped and would be lost:\n%s\nSnap them first or run restore again with --force", strings.Join(pending, "\n"))
+	}
+
+	return nil
+}
+
+// inScope reports whether path is selected for restoring and records which
+// of the requested paths matched it.
+func (rm *RestoreManager) inScope(path string, matched map[string]bool) bool {
+	if len(rm.Paths) == 0 {
+		return true
+	}
+
+	found := false
+	for _, selected := range rm.Paths {
+		if selected == "." || path == selected || strings.HasPrefix(path, selected+"/") {
+			matched[selected] = true
+			found = true
+		}
+	}
+
+	return found
+}
+
+// localPath turns a path from a snapshot into one in the working directory.
+// Snapshots can come from bundles made elsewhere, so paths that are absolute,
+// climb out with .., point into .subsys or go through a link leading out of
+// the directory are refused.
+func localPath(name string) (string, error) {
+	path := filepath.FromSlash(name)
+	if !filepath.IsLocal(path) || strings.Contains(name, `\`) {
+		return "", fmt.Errorf("%s is outside of the subsys directory", name)
+	}
+
+	if strings.SplitN(filepath.ToSlash(filepath.Clean(path)), "/", 2)[0] == ".subsys" {
+		return "", fmt.Errorf("%s is inside the .subsys directory", name)
+	}
+
+	root, err := filepath.EvalSymlinks(".")
+	if err != nil {
+		return "", err
+	}
+
+	// Directories that don't exist yet are created as real ones, so only the
+	// deepest existing one can lead elsewhere
+	for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		relative, err := filepath.Rel(root, resolved)
+		if err != nil || !filepath.IsLocal(relative) {
+			return "", fmt.Errorf("%s is outside of the subsys directory, %s links elsewhere", name, filepath.ToSlash(dir))
+		}
+		break
+	}
+
+	return path, nil
+}
+
+func restoreFile(file dirsnap.SnapshotFile) error {
+	path, err := localPath(file.Path)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		return err
+	}
+
+	object, err := utils.ReadObject(file.Hash)
+	if err != nil {
+		return fmt.Errorf("missing object for %s: %v", file.Path, err)
+	}
+	defer object.Close()
+
+	if file.Mode&os.ModeSymlink != 0 {
+		target, err := io.ReadAll(object)
+		if err != nil {
+			return err
+		}
+
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return os.Symlink(string(target), path)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".restore-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = io.Copy(tmp, object)
+	if err != nil {
+		return err
+	}
+
+	err = tmp.Chmod(file.Mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func removeEmptyParents(path string) {
+	for dir := filepath.Dir(path); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
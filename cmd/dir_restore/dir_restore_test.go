@@ -0,0 +1,374 @@
+package dirrestore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dirinit "amalitech.org/subsys/cmd/dir_init"
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+	"amalitech.org/subsys/utils"
+)
+
+func SetupRestoreTests(t *testing.T) *RestoreManager {
+	tempDir := t.TempDir()
+
+	err := os.Chdir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to change working directory: %v", err)
+	}
+
+	initializer, err := dirinit.NewDirectoryInitializer()
+	if err != nil {
+		t.Fatalf("NewDirectoryInitializer failed: %v", err)
+	}
+
+	err = initializer.Initialize()
+	if err != nil {
+		t.Fatalf("InitializeDirectory failed: %v", err)
+	}
+
+	os.MkdirAll("src", 0777)
+	os.WriteFile("main.py", []byte("working code"), 0644)
+	os.WriteFile(filepath.Join("src", "lib.py"), []byte("library"), 0644)
+
+	os.Args = []string{"program", "snap", "--name", "working"}
+	err = dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	os.WriteFile("main.py", []byte("broken code"), 0644)
+	os.WriteFile("notes.txt", []byte("notes"), 0644)
+	os.RemoveAll("src")
+
+	os.Args = []string{"program", "snap", "--name", "broken"}
+	err = dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	return NewRestoreManager()
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading %s: %v", path, err)
+	}
+	return string(data)
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	rm := SetupRestoreTests(t)
+
+	os.Args = []string{"program", "restore", "--name", "working"}
+	err := rm.RestoreSnapshot()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if got := readFile(t, "main.py"); got != "working code" {
+		t.Errorf("Expected main.py to be restored, got %q", got)
+	}
+
+	if got := readFile(t, filepath.Join("src", "lib.py")); got != "library" {
+		t.Errorf("Expected src/lib.py to be restored, got %q", got)
+	}
+
+	if _, err := os.Stat("notes.txt"); !os.IsNotExist(err) {
+		t.Errorf("Expected notes.txt to be removed, got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(".subsys", "config.json")); err != nil {
+		t.Errorf("Expected .subsys to be left alone: %v", err)
+	}
+
+	tracker, err := dirsnap.ReadTracker(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tracker.Files["notes.txt"]; ok || tracker.Files["src/lib.py"].Hash == "" {
+		t.Errorf("Expected the tracker to match the restored snapshot, got %v", tracker)
+	}
+
+	changes, err := (&dirsnap.SnapshotManager{}).PendingChanges(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range changes {
+		if change.Path != "" {
+			t.Errorf("Expected no pending changes after restore, got %v", change)
+		}
+	}
+}
+
+func TestRestorePaths(t *testing.T) {
+	rm := SetupRestoreTests(t)
+
+	os.Args = []string{"program", "restore", "--name", "working", "src"}
+	err := rm.RestoreSnapshot()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if got := readFile(t, filepath.Join("src", "lib.py")); got != "library" {
+		t.Errorf("Expected src/lib.py to be restored, got %q", got)
+	}
+
+	if got := readFile(t, "main.py"); got != "broken code" {
+		t.Errorf("Expected main.py to be left alone, got %q", got)
+	}
+
+	if got := readFile(t, "notes.txt"); got != "notes" {
+		t.Errorf("Expected notes.txt to be left alone, got %q", got)
+	}
+}
+
+func TestRestoreRefusesUnsnappedChanges(t *testing.T) {
+	rm := SetupRestoreTests(t)
+
+	os.WriteFile("main.py", []byte("unsnapped work"), 0644)
+
+	os.Args = []string{"program", "restore", "--name", "working"}
+	err := rm.RestoreSnapshot()
+	if err == nil || !strings.Contains(err.Error(), "main.py") {
+		t.Fatalf("Expected restore to refuse overwriting main.py, got %v", err)
+	}
+
+	if got := readFile(t, "main.py"); got != "unsnapped work" {
+		t.Errorf("Expected main.py to be left alone, got %q", got)
+	}
+
+	rm = NewRestoreManager()
+	os.Args = []string{"program", "restore", "--name", "working", "--force"}
+	err = rm.RestoreSnapshot()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if got := readFile(t, "main.py"); got != "working code" {
+		t.Errorf("Expected main.py to be restored with --force, got %q", got)
+	}
+}
+
+func TestRestoreUnknownPath(t *testing.T) {
+	rm := SetupRestoreTests(t)
+
+	os.Args = []string{"program", "restore", "--name", "working", "missing.py"}
+	err := rm.RestoreSnapshot()
+	if err == nil {
+		t.Error("Expected an error for a path that isn't in the snapshot, but got none")
+	}
+}
+
+func TestRestoreLinksModesAndEmptyDirs(t *testing.T) {
+	rm := SetupRestoreTests(t)
+
+	os.WriteFile("run.sh", []byte("#!/bin/sh\n"), 0755)
+	os.Symlink("run.sh", "start.sh")
+	os.MkdirAll(filepath.Join("assets", "empty"), 0777)
+
+	os.Args = []string{"program", "snap", "--name", "scripts"}
+	err := dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	// Replace the link with a file, drop the executable bit and the empty directory
+	os.Remove("start.sh")
+	os.WriteFile("start.sh", []byte("not a link"), 0644)
+	os.Chmod("run.sh", 0644)
+	os.RemoveAll("assets")
+
+	rm.SnapshotName = "scripts"
+	rm.Force = true
+	err = rm.Restore()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	target, err := os.Readlink("start.sh")
+	if err != nil || target != "run.sh" {
+		t.Errorf("Expected start.sh to be a link to run.sh again, got %q (%v)", target, err)
+	}
+
+	info, err := os.Stat("run.sh")
+	if err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("Expected run.sh to be executable again, got %v (%v)", info.Mode(), err)
+	}
+
+	info, err = os.Stat(filepath.Join("assets", "empty"))
+	if err != nil || !info.IsDir() {
+		t.Errorf("Expected assets/empty to be recreated, got %v", err)
+	}
+
+	changes, err := (&dirsnap.SnapshotManager{}).PendingChanges(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("Expected no pending changes after restoring, got %v", changes)
+	}
+}
+
+func TestRestoreFromSubdirectory(t *testing.T) {
+	SetupRestoreTests(t)
+	t.Cleanup(func() { utils.Prefix = "" })
+
+	os.Mkdir("src", 0777)
+	os.Chdir("src")
+	err := utils.EnterRoot("")
+	if err != nil {
+		t.Fatalf("EnterRoot failed: %v", err)
+	}
+
+	os.Args = []string{"program", "restore", "--name", "working", "lib.py"}
+	err = NewRestoreManager().RestoreSnapshot()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if got := readFile(t, filepath.Join("src", "lib.py")); got != "library" {
+		t.Errorf("Expected src/lib.py to be restored, got %q", got)
+	}
+
+	if got := readFile(t, "main.py"); got != "broken code" {
+		t.Errorf("Expected main.py to be left alone, got %q", got)
+	}
+}
+
+func TestRestoreRefusesPathsOutside(t *testing.T) {
+	SetupRestoreTests(t)
+	outside := t.TempDir()
+
+	snapshot, err := dirsnap.LoadSnapshot("working")
+	if err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+	file := snapshot.Files[0]
+	escaping := func(path string) dirsnap.SnapshotFile {
+		return dirsnap.SnapshotFile{Path: path, Hash: file.Hash, CRC32: file.CRC32, Size: file.Size, Mode: file.Mode}
+	}
+
+	link, _ := utils.StoreReader(strings.NewReader(outside))
+	tests := [][]dirsnap.SnapshotFile{
+		{escaping("../escaped.py")},
+		{escaping(filepath.ToSlash(filepath.Join(outside, "escaped.py")))},
+		{{Path: "elsewhere", Hash: link.Hash, CRC32: link.CRC32, Size: link.Size, Mode: os.ModeSymlink | 0777}, escaping("elsewhere/escaped.py")},
+	}
+
+	for _, files := range tests {
+		tampered := snapshot
+		tampered.Name = "tampered"
+		tampered.Files = files
+		tampered.Save()
+
+		os.Args = []string{"program", "restore", "--name", "tampered", "--force"}
+		err = NewRestoreManager().RestoreSnapshot()
+		if err == nil || !strings.Contains(err.Error(), "outside of the subsys directory") {
+			t.Errorf("Expected restoring %s to be refused, got %v", files[len(files)-1].Path, err)
+		}
+	}
+
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("Expected nothing to be written outside of the directory, got %v", entries)
+	}
+	if _, err := os.Stat(filepath.Join("..", "escaped.py")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be written outside of the directory")
+	}
+}
+
+func TestRestoredSnapshotArchivesTheSame(t *testing.T) {
+	rm := SetupRestoreTests(t)
+
+	// Large enough that deflating it at another level would change it
+	var data strings.Builder
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&data, "line %d of %d, %x\n", i, i*i%97, i*7919)
+	}
+	os.WriteFile("data.txt", []byte(data.String()), 0644)
+
+	os.Args = []string{"program", "snap", "--name", "data"}
+	err := dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	os.WriteFile("data.txt", []byte("truncated"), 0644)
+	os.Args = []string{"program", "snap", "--name", "truncated"}
+	err = dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	rm.SnapshotName = "data"
+	rm.Force = true
+	err = rm.Restore()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Make the restored files look older than the tracker, so they are
+	// snapped again from what the restore tracked rather than read again
+	tracker, err := dirsnap.ReadTracker(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	for path, file := range tracker.Files {
+		os.Chtimes(path, old, old)
+		info, _ := os.Lstat(path)
+		file.ModTime = info.ModTime()
+		tracker.Files[path] = file
+	}
+	err = tracker.Save(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile("extra.txt", []byte("extra"), 0644)
+	os.Args = []string{"program", "snap", "--name", "extra"}
+	err = dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	os.Remove("extra.txt")
+	os.Args = []string{"program", "snap", "--name", "again"}
+	err = dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	first, err := dirsnap.LoadSnapshot("data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := dirsnap.LoadSnapshot("again")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the files should differ, if anything does
+	again.Name = first.Name
+	again.CreatedAt = first.CreatedAt
+
+	var firstArchive, againArchive bytes.Buffer
+	err = first.WriteArchive(&firstArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = again.WriteArchive(&againArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(firstArchive.Bytes(), againArchive.Bytes()) {
+		t.Error("Expected snapping the restored files to give the same archive")
+	}
+}
@@ -0,0 +1,389 @@
+package dirsnap
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"amalitech.org/subsys/utils"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ArchiveEntry is a file, link or directory in a snapshot archive. A link's
+// contents are its target, and directories have none.
+type ArchiveEntry struct {
+	Name    string
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time
+}
+
+type ArchiveWriter interface {
+	WriteEntry(entry ArchiveEntry, contents io.Reader) error
+	Close() error
+}
+
+// rawArchiveWriter is implemented by formats that can take a deflated object
+// from the store as it is, without decompressing it first.
+type rawArchiveWriter interface {
+	WriteRawEntry(entry ArchiveEntry, crc uint32, deflated io.Reader, compressedSize int64) error
+}
+
+// ArchiveFormat is a way of packing a snapshot into a single file for
+// submission.
+type ArchiveFormat interface {
+	Name() string
+	Extension() string
+	NewWriter(w io.Writer) (ArchiveWriter, error)
+
+	// Walk calls fn for every entry of an archive, in the order they were written.
+	Walk(data []byte, fn func(entry ArchiveEntry, contents io.Reader) error) error
+
+	matches(data []byte) bool
+}
+
+var archiveFormats = []ArchiveFormat{
+	zipFormat{},
+	tarFormat{
+		name:  "tar.gz",
+		magic: []byte{0x1f, 0x8b},
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	tarFormat{
+		name:  "tar.zst",
+		magic: []byte{0x28, 0xb5, 0x2f, 0xfd},
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			// A single encoder keeps the output the same on every machine
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	},
+}
+
+// archiveEpoch is the modification time of every archive entry. Using a fixed
+// time instead of each file's own, along with sorted entries and normalised
+// modes, makes archives of the same snapshot byte-identical.
+var archiveEpoch = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// normalizeMode keeps only what an archive needs of a mode: whether the entry
+// is a directory, a link or executable.
+func normalizeMode(mode os.FileMode) os.FileMode {
+	switch {
+	case mode.IsDir():
+		return os.ModeDir | 0755
+	case mode&os.ModeSymlink != 0:
+		return os.ModeSymlink | 0777
+	case mode&0111 != 0:
+		return 0755
+	default:
+		return 0644
+	}
+}
+
+// DefaultArchiveFormat is used when neither snap --format nor the config pick one.
+const DefaultArchiveFormat = "zip"
+
+func ArchiveFormatNames() []string {
+	names := make([]string, 0, len(archiveFormats))
+	for _, format := range archiveFormats {
+		names = append(names, format.Name())
+	}
+	return names
+}
+
+// ArchiveFormatByName looks up a format, an empty name being the default one.
+func ArchiveFormatByName(name string) (ArchiveFormat, error) {
+	if name == "" {
+		name = DefaultArchiveFormat
+	}
+
+	for _, format := range archiveFormats {
+		if format.Name() == name {
+			return format, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown archive format %s, use one of %s", name, strings.Join(ArchiveFormatNames(), ", "))
+}
+
+// DetectArchiveFormat recognises an archive from its first bytes.
+func DetectArchiveFormat(data []byte) (ArchiveFormat, error) {
+	for _, format := range archiveFormats {
+		if format.matches(data) {
+			return format, nil
+		}
+	}
+
+	return nil, fmt.Errorf("not a snapshot archive, expected one of %s", strings.Join(ArchiveFormatNames(), ", "))
+}
+
+// HasArchiveExtension reports whether path names an archive file, encrypted
+// or not, rather than a snapshot.
+func HasArchiveExtension(path string) bool {
+	path = strings.TrimSuffix(path, utils.EncryptedExtension)
+	for _, format := range archiveFormats {
+		if strings.HasSuffix(path, format.Extension()) {
+			return true
+		}
+	}
+	return false
+}
+
+type zipFormat struct{}
+
+func (zipFormat) Name() string {
+	return "zip"
+}
+
+func (zipFormat) Extension() string {
+	return ".zip"
+}
+
+func (zipFormat) matches(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("PK\x03\x04")) || bytes.HasPrefix(data, []byte("PK\x05\x06"))
+}
+
+func (zipFormat) NewWriter(w io.Writer) (ArchiveWriter, error) {
+	writer := zip.NewWriter(w)
+
+	// Entries that aren't copied from the object store, like the manifest,
+	// are deflated at the same level as the objects that are
+	writer.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, utils.CompressionLevel)
+	})
+
+	return &zipArchiveWriter{writer: writer}, nil
+}
+
+func (zipFormat) Walk(data []byte, fn func(entry ArchiveEntry, contents io.Reader) error) error {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range reader.File {
+		entry := ArchiveEntry{
+			Name:    strings.TrimSuffix(file.Name, "/"),
+			Mode:    file.Mode(),
+			Size:    int64(file.UncompressedSize64),
+			ModTime: file.Modified,
+		}
+
+		if entry.Mode.IsDir() {
+			err = fn(entry, strings.NewReader(""))
+		} else {
+			err = walkZipFile(file, entry, fn)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func walkZipFile(file *zip.File, entry ArchiveEntry, fn func(entry ArchiveEntry, contents io.Reader) error) error {
+	rc, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return fn(entry, rc)
+}
+
+type zipArchiveWriter struct {
+	writer *zip.Writer
+}
+
+func (z *zipArchiveWriter) header(entry ArchiveEntry) *zip.FileHeader {
+	header := &zip.FileHeader{
+		Name:     entry.Name,
+		Method:   zip.Deflate,
+		Modified: entry.ModTime,
+	}
+
+	if entry.Mode.IsDir() {
+		header.Name += "/"
+		header.Method = zip.Store
+	}
+
+	header.SetMode(entry.Mode)
+	return header
+}
+
+func (z *zipArchiveWriter) WriteEntry(entry ArchiveEntry, contents io.Reader) error {
+	writer, err := z.writer.CreateHeader(z.header(entry))
+	if err != nil {
+		return err
+	}
+
+	if contents == nil {
+		return nil
+	}
+
+	_, err = io.Copy(writer, contents)
+	return err
+}
+
+func (z *zipArchiveWriter) WriteRawEntry(entry ArchiveEntry, crc uint32, deflated io.Reader, compressedSize int64) error {
+	header := z.header(entry)
+	header.CRC32 = crc
+	header.CompressedSize64 = uint64(compressedSize)
+	header.UncompressedSize64 = uint64(entry.Size)
+
+	writer, err := z.writer.CreateRaw(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, deflated)
+	return err
+}
+
+func (z *zipArchiveWriter) Close() error {
+	return z.writer.Close()
+}
+
+// tarFormat is a tarball compressed as a whole. Unlike zip, tar keeps Unix
+// permissions and links natively.
+type tarFormat struct {
+	name       string
+	magic      []byte
+	compress   func(w io.Writer) (io.WriteCloser, error)
+	decompress func(r io.Reader) (io.ReadCloser, error)
+}
+
+func (t tarFormat) Name() string {
+	return t.name
+}
+
+func (t tarFormat) Extension() string {
+	return "." + t.name
+}
+
+func (t tarFormat) matches(data []byte) bool {
+	return bytes.HasPrefix(data, t.magic)
+}
+
+func (t tarFormat) NewWriter(w io.Writer) (ArchiveWriter, error) {
+	compressor, err := t.compress(w)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tarArchiveWriter{compressor: compressor, writer: tar.NewWriter(compressor)}, nil
+}
+
+func (t tarFormat) Walk(data []byte, fn func(entry ArchiveEntry, contents io.Reader) error) error {
+	decompressor, err := t.decompress(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer decompressor.Close()
+
+	reader := tar.NewReader(decompressor)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		entry := ArchiveEntry{
+			Name:    strings.TrimSuffix(header.Name, "/"),
+			Mode:    os.FileMode(header.Mode).Perm(),
+			Size:    header.Size,
+			ModTime: header.ModTime,
+		}
+
+		var contents io.Reader = reader
+		switch header.Typeflag {
+		case tar.TypeReg:
+		case tar.TypeDir:
+			entry.Mode |= os.ModeDir
+		case tar.TypeSymlink:
+			entry.Mode |= os.ModeSymlink
+			entry.Size = int64(len(header.Linkname))
+			contents = strings.NewReader(header.Linkname)
+		default:
+			return fmt.Errorf("%s has an entry type subsys doesn't support", header.Name)
+		}
+
+		err = fn(entry, contents)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type tarArchiveWriter struct {
+	compressor io.WriteCloser
+	writer     *tar.Writer
+}
+
+func (t *tarArchiveWriter) WriteEntry(entry ArchiveEntry, contents io.Reader) error {
+	header := &tar.Header{
+		Name:    entry.Name,
+		Mode:    int64(entry.Mode.Perm()),
+		ModTime: entry.ModTime,
+		Format:  tar.FormatPAX,
+	}
+
+	switch {
+	case entry.Mode.IsDir():
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+	case entry.Mode&os.ModeSymlink != 0:
+		target, err := io.ReadAll(contents)
+		if err != nil {
+			return err
+		}
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = string(target)
+	default:
+		header.Typeflag = tar.TypeReg
+		header.Size = entry.Size
+	}
+
+	err := t.writer.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	_, err = io.Copy(t.writer, contents)
+	return err
+}
+
+func (t *tarArchiveWriter) Close() error {
+	err := t.writer.Close()
+	if err != nil {
+		return err
+	}
+
+	return t.compressor.Close()
+}
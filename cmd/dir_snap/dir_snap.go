@@ -1,19 +1,19 @@
 package dirsnap
 
 import (
-	"archive/zip"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"amalitech.org/subsys/utils"
 )
@@ -24,16 +24,86 @@ const (
 	Added Status = iota
 	Modified
 	Deleted
+	Renamed
+	Copied
 )
 
+func (s Status) String() string {
+	switch s {
+	case Added:
+		return "Added"
+	case Modified:
+		return "Modified"
+	case Deleted:
+		return "Deleted"
+	case Renamed:
+		return "Renamed"
+	case Copied:
+		return "Copied"
+	default:
+		return "Unknown"
+	}
+}
+
+func (s Status) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Status) UnmarshalText(text []byte) error {
+	for _, status := range []Status{Added, Modified, Deleted, Renamed, Copied} {
+		if status.String() == string(text) {
+			*s = status
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown change status: %s", text)
+}
+
+// FileChange is a change to one file. Renamed and copied files also record the
+// path they came from and how similar, in percent, they still are to it.
 type FileChange struct {
-	Path   string
-	Status Status
+	Path       string `json:"path"`
+	Status     Status `json:"status"`
+	From       string `json:"from,omitempty"`
+	Similarity int    `json:"similarity,omitempty"`
+	Insertions int    `json:"insertions,omitempty"`
+	Deletions  int    `json:"deletions,omitempty"`
+	Binary     bool   `json:"binary,omitempty"`
+}
+
+// DisplayPath is the changed path, shown as "from -> to" for renames and copies.
+func (c FileChange) DisplayPath() string {
+	if c.From != "" {
+		return c.From + " -> " + c.Path
+	}
+	return c.Path
+}
+
+// Label is the display path, noting how similar an edited rename still is.
+func (c FileChange) Label() string {
+	if c.From != "" && c.Similarity < 100 {
+		return fmt.Sprintf("%s (%d%% similar)", c.DisplayPath(), c.Similarity)
+	}
+	return c.DisplayPath()
+}
+
+func (c FileChange) String() string {
+	return fmt.Sprintf("%s: %s", c.Status, c.Label())
 }
 
 type SnapshotManager struct {
-	Config utils.AssignmentConfig
-	Name   string
+	Config  utils.AssignmentConfig
+	Name    string
+	Message string
+	Force   bool
+	Format  string
+	DryRun  bool
+	Include []string
+	Exclude []string
+	changes []FileChange
+	tracker *Tracker
+	secrets []SecretFinding
 }
 
 func NewSnapshotManager() *SnapshotManager {
@@ -53,29 +123,121 @@ func NewSnapshotManager() *SnapshotManager {
 
 	return &SnapshotManager{
 		Config: configData,
+		Format: config.ArchiveFormat,
 	}
 }
 
 func (sm *SnapshotManager) CreateSnapshot() error {
 	err := sm.GetSnapshotName()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	if sm.Config.StudentID == "" || sm.Config.AssignmentCode == "" {
+		fmt.Println("Warning: this directory isn't configured yet, so the snapshot won't record your student ID and assignment code")
+	}
+
+	if sm.DryRun {
+		return sm.Preview()
+	}
+
+	return sm.Snap()
+}
+
+// ErrNoChanges is returned by Snap when the tree hasn't changed since the latest snapshot.
+var ErrNoChanges = errors.New("no new changes")
+
+// Snap makes a snapshot named sm.Name of the working directory, running the
+// pre-snap and post-snap hooks around it. Every snapshot goes through here,
+// automatic ones included, so the hooks see all of them.
+func (sm *SnapshotManager) Snap() error {
+	hookEnv := map[string]string{"SNAPSHOT": sm.Name, "MESSAGE": sm.Message}
+	err := utils.RunHook(".", utils.PreSnapHook, ".", hookEnv)
+	if err != nil {
+		return err
 	}
 
-	changes, err := sm.TrackChanges("./")
+	err = sm.snap()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	if len(changes) == 0 {
-		return fmt.Errorf("no new changes")
+	hookEnv["SNAPSHOT_PATH"] = SnapshotPath(sm.Name)
+	err = utils.RunHook(".", utils.PostSnapHook, ".", hookEnv)
+	if err != nil {
+		return fmt.Errorf("snapshot %s was made, but %w", sm.Name, err)
+	}
+
+	return nil
+}
+
+// snap stores the changed files' objects, saves the snapshot and records the
+// new state in the tracker.
+func (sm *SnapshotManager) snap() error {
+	latest, err := LatestSnapshot()
+	if err != nil {
+		return err
+	}
+
+	previous, err := ReadTracker(".")
+	if err != nil {
+		return err
+	}
+
+	// Files are only hashed at first, so nothing is stored until they are
+	// known to hold no secrets
+	filter := NewFilter(sm.Include, sm.Exclude)
+	current, err := scanFilteredTree(".", previous, false, filter)
+	if err != nil {
+		return err
+	}
+
+	previous = filter.narrow(previous)
+	changes := sm.compareSnapshot(".", previous, current)
+
+	// The first snapshot is always made, even of an empty directory
+	if len(changes) == 0 && latest != "" {
+		return ErrNoChanges
+	}
+
+	blocked, allowed, err := ScanSecrets(".", current, changes)
+	if err != nil {
+		return err
+	}
+	if len(blocked) > 0 {
+		return &SecretsError{Findings: blocked}
+	}
+
+	before, after := trackerContents(".", previous, current)
+	CountLines(changes, before, after)
+
+	err = storeTree(".", current, filter)
+	if err != nil {
+		return err
 	}
 
 	sm.printChanges(changes)
+	if len(allowed) > 0 {
+		fmt.Printf("Warning: snapping %d possible secret(s) allowed by %s, they're recorded in the snapshot\n", len(allowed), AllowFile)
+	}
+	sm.changes = changes
+	sm.tracker = current
+	sm.secrets = allowed
 
 	err = sm.compress()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	// The tracker is only updated once the snapshot is saved, so a snap that
+	// fails or is interrupted leaves the changes to be picked up by the next.
+	// A filtered snapshot doesn't update it at all, as the files it left out
+	// would look deleted to the next snapshot
+	if filter == nil {
+		err = current.Save(".")
+		if err != nil {
+			return err
+		}
 	}
 
 	fmt.Printf("Snapshot %s created successfully\n", sm.Name)
@@ -83,255 +245,450 @@ func (sm *SnapshotManager) CreateSnapshot() error {
 	return nil
 }
 
-func (sm *SnapshotManager) TrackChanges(dir string) ([]FileChange, error) {
-	trackerPath := filepath.Join(dir, ".subsys", ".track")
-
-	tracker, err := ioutil.ReadFile(trackerPath)
+// storeTree stores the objects of the files scanned into a tracker. A file
+// that changed since it was scanned fails the snapshot, as what's stored
+// would be neither what was compared nor what was checked for secrets.
+func storeTree(dir string, scanned *Tracker, filter *Filter) error {
+	stored, err := scanFilteredTree(dir, scanned, true, filter)
+	if err != nil {
+		return err
+	}
 
-	if err == nil {
-		return sm.compareSnapshot(tracker, dir)
-	} else if os.IsNotExist(err) {
-		changes, err := sm.scanDir(dir)
-		if err != nil {
-			return nil, err
+	changed := len(stored.Files) != len(scanned.Files)
+	for path, file := range stored.Files {
+		if scanned.Files[path].Hash != file.Hash {
+			changed = true
 		}
+	}
+	if changed {
+		return errors.New("your files changed while they were being snapped, snap again")
+	}
 
-		tracker, err := sm.createTracker(dir)
-		if err != nil {
-			return nil, err
-		}
+	return nil
+}
 
-		err = ioutil.WriteFile(trackerPath, tracker, 0644)
-		if err != nil {
-			return nil, err
-		}
+// PendingChanges returns the changes since the last snapshot without touching the tracker.
+func (sm *SnapshotManager) PendingChanges(dir string) ([]FileChange, error) {
+	previous, err := ReadTracker(dir)
+	if err != nil {
+		return nil, err
+	}
 
-		return changes, nil
-	} else {
+	if previous == nil {
+		return sm.scanDir(dir)
+	}
+
+	current, err := sm.createTracker(dir, previous)
+	if err != nil {
 		return nil, err
 	}
+
+	return sm.compareSnapshot(dir, previous, current), nil
 }
 
-func (sm *SnapshotManager) compareSnapshot(snapshot []byte, dir string) ([]FileChange, error) {
+// compareSnapshot lists the differences between two trackers, sorted by path.
+// The current tracker describes the files in dir.
+func (sm *SnapshotManager) compareSnapshot(dir string, previous *Tracker, current *Tracker) []FileChange {
 	changes := make([]FileChange, 0)
 
-	lines := strings.Split(string(snapshot), "\n")
+	if previous == nil {
+		previous = NewTracker()
+	}
 
-	for _, line := range lines {
-		file := strings.TrimSpace(line)
+	for path, file := range current.Files {
+		tracked, ok := previous.Files[path]
+		if !ok {
+			changes = append(changes, FileChange{Path: path, Status: Added})
+		} else if tracked.Hash != file.Hash || ModeChanged(tracked.Mode, file.Mode) {
+			changes = append(changes, FileChange{Path: path, Status: Modified})
+		}
+	}
 
-		currentPath := strings.Split(file, " ")
+	for path := range previous.Files {
+		if _, ok := current.Files[path]; !ok {
+			changes = append(changes, FileChange{Path: path, Status: Deleted})
+		}
+	}
 
-		_, err := os.Stat(currentPath[0])
-		if err != nil {
-			if os.IsNotExist(err) {
-				changes = append(changes, FileChange{Path: file, Status: Deleted})
-			} else {
-				return nil, err
-			}
-		} else {
+	before, after := trackerContents(dir, previous, current)
+	return DetectRenames(changes, before, after)
+}
 
-			currentHash, err := sm.checksum(currentPath[0])
-			if err != nil {
-				return nil, err
-			}
+// trackerContents reads the files of two trackers, the previous one's from the
+// object store and the current one's from the store or, for files not stored
+// yet, from dir.
+func trackerContents(dir string, previous *Tracker, current *Tracker) (TreeContents, TreeContents) {
+	if previous == nil {
+		previous = NewTracker()
+	}
 
-			snapshotHash := ""
-			for _, trackLine := range lines {
-				trackerPath := strings.Split(trackLine, " ")
-				if trackerPath[0] == currentPath[0] {
-					snapshotHash = trackerPath[1]
-				}
-			}
-			if currentHash != snapshotHash {
-				changes = append(changes, FileChange{Path: file, Status: Modified})
-			}
+	before := previous.contents(func(path string) ([]byte, error) {
+		return readObject(previous.Files[path].Hash)
+	})
+
+	after := current.contents(func(path string) ([]byte, error) {
+		if data, err := readObject(current.Files[path].Hash); err == nil {
+			return data, nil
+		}
+
+		if current.Files[path].Mode&os.ModeSymlink != 0 {
+			target, err := os.Readlink(filepath.Join(dir, path))
+			return []byte(target), err
 		}
+		return os.ReadFile(filepath.Join(dir, path))
+	})
+
+	return before, after
+}
+
+// ModeChanged reports whether a file became, or stopped being, a link or
+// executable. Trackers written by older versions of subsys have no modes.
+func ModeChanged(before os.FileMode, after os.FileMode) bool {
+	if before == 0 || after == 0 {
+		return false
 	}
+	return before.Type() != after.Type() || before.Perm()&0111 != after.Perm()&0111
+}
 
-	newFiles, err := sm.scanDir(dir)
+func readObject(hash string) ([]byte, error) {
+	object, err := utils.ReadObject(hash)
 	if err != nil {
 		return nil, err
 	}
+	defer object.Close()
 
-	trackComparison := fmt.Sprintf("%v", lines)
+	return io.ReadAll(object)
+}
 
-	for _, newFile := range newFiles {
-		if !strings.Contains(trackComparison, newFile.Path) {
-			changes = append(changes, newFile)
-		}
-	}
+func (sm *SnapshotManager) scanDir(dir string) ([]FileChange, error) {
+	changes := make([]FileChange, 0)
 
-	if len(changes) > 0 {
-		tracker, err := sm.createTracker(dir)
-		if err != nil {
-			return nil, err
+	err := walkTree(dir, func(path string, info os.FileInfo) error {
+		if info.IsDir() {
+			return nil
 		}
+		changes = append(changes, FileChange{Path: path, Status: Added})
+		return nil
+	})
 
-		err = ioutil.WriteFile(filepath.Join(dir, ".subsys", ".track"), tracker, 0644)
-		if err != nil {
-			return nil, err
-		}
+	if err != nil {
+		return nil, err
 	}
 
 	return changes, nil
 }
 
-func (sm *SnapshotManager) scanDir(dir string) ([]FileChange, error) {
-	changes := make([]FileChange, 0)
+// createTracker records the current state of dir. Files whose size, mode and
+// mtime match the previous tracker keep their hash instead of being read again.
+func (sm *SnapshotManager) createTracker(dir string, previous *Tracker) (*Tracker, error) {
+	return scanTree(dir, previous, false)
+}
 
-	ignoredFiles, err := utils.GetIgnoredFiles(filepath.Join(".", "subsysignore"))
+// walkTree calls fn for every file and directory in dir that isn't ignored by
+// the subsysignore files in dir and its subdirectories. Ignored directories
+// are pruned rather than walked file by file. Symbolic links are reported as
+// they are and never followed, so a link to one of its own parents can't make
+// the walk loop.
+func walkTree(dir string, fn func(path string, info os.FileInfo) error) error {
+	ignored, err := utils.LoadIgnoreMatcher(dir)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		if !info.IsDir() && !utils.Contains(ignoredFiles, path) {
-			changes = append(changes, FileChange{Path: path, Status: Added})
+		relative, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
 		}
 
-		return nil
+		if relative == "." {
+			return nil
+		}
+
+		if ignored.Ignored(relative, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		return fn(path, info)
 	})
+}
 
-	if err != nil {
-		return nil, err
+// scanTree walks dir once and hashes its files on a pool of workers. With
+// store set, the files are also deflated into the object store in the same
+// read, so a snapshot reads each changed file exactly once. Directories with
+// nothing in them are recorded too, so they can be recreated.
+func scanTree(dir string, previous *Tracker, store bool) (*Tracker, error) {
+	return scanFilteredTree(dir, previous, store, nil)
+}
+
+// scanFilteredTree is scanTree leaving out the files filter doesn't keep.
+func scanFilteredTree(dir string, previous *Tracker, store bool, filter *Filter) (*Tracker, error) {
+	type job struct {
+		path     string
+		relative string
+		info     os.FileInfo
 	}
 
-	return changes, nil
-}
+	if previous == nil {
+		previous = NewTracker()
+	}
 
-func (sm *SnapshotManager) createTracker(dir string) ([]byte, error) {
-	hashes := make([]string, 0)
+	tracker := NewTracker()
+	dirs := []string{}
+	jobs := make(chan job, 64)
+	failed := make(chan struct{})
+
+	var (
+		mutex     sync.Mutex
+		waitGroup sync.WaitGroup
+		failOnce  sync.Once
+		failure   error
+	)
+
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failure = err
+			close(failed)
+		})
+	}
 
-	ignoredFiles, err := utils.GetIgnoredFiles(filepath.Join(".", "subsysignore"))
-	if err != nil {
-		return nil, err
+	for i := 0; i < runtime.NumCPU(); i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for job := range jobs {
+				file, err := trackFile(job.path, job.info, previous, job.relative, store)
+				if err != nil {
+					fail(err)
+					continue
+				}
+
+				mutex.Lock()
+				tracker.Files[job.relative] = file
+				mutex.Unlock()
+			}
+		}()
 	}
 
-	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+	walkErr := walkTree(dir, func(path string, info os.FileInfo) error {
+		relative, err := filepath.Rel(dir, path)
 		if err != nil {
 			return err
 		}
 
-		if !info.IsDir() && !utils.Contains(ignoredFiles, path) {
-			hash, err := sm.checksum(path)
-			if err != nil {
-				return err
+		relative = filepath.ToSlash(relative)
+		if info.IsDir() {
+			if !filter.keepDir(relative) {
+				return filepath.SkipDir
 			}
+			if filter.keepsEmptyDirs() {
+				dirs = append(dirs, relative)
+			}
+			return nil
+		}
 
-			hashes = append(hashes, fmt.Sprintf("%s %s", filepath.ToSlash(path), hash))
+		if !filter.keepFile(relative) {
+			return nil
 		}
 
-		return nil
+		select {
+		case jobs <- job{path: path, relative: relative, info: info}:
+			return nil
+		case <-failed:
+			return filepath.SkipAll
+		}
 	})
 
-	if err != nil {
-		return nil, err
+	close(jobs)
+	waitGroup.Wait()
+
+	if walkErr != nil {
+		return nil, walkErr
+	}
+
+	if failure != nil {
+		return nil, failure
+	}
+
+	tracker.EmptyDirs = emptyDirs(dirs, tracker.Files)
+	return tracker, nil
+}
+
+// emptyDirs returns the directories, in order, that contain no files and no
+// other directories.
+func emptyDirs(dirs []string, files map[string]TrackedFile) []string {
+	used := map[string]bool{}
+	markParents := func(name string) {
+		for i := strings.LastIndex(name, "/"); i > 0 && !used[name[:i]]; i = strings.LastIndex(name, "/") {
+			name = name[:i]
+			used[name] = true
+		}
+	}
+
+	for name := range files {
+		markParents(name)
+	}
+	for _, dir := range dirs {
+		markParents(dir)
 	}
 
-	snapshot := strings.Join(hashes, "\n")
+	empty := []string{}
+	for _, dir := range dirs {
+		if !used[dir] {
+			empty = append(empty, dir)
+		}
+	}
 
-	return []byte(snapshot), nil
+	sort.Strings(empty)
+	return empty
 }
 
-func (sm *SnapshotManager) checksum(path string) (string, error) {
-	file, err := os.Open(path)
+func trackFile(path string, info os.FileInfo, previous *Tracker, relative string, store bool) (TrackedFile, error) {
+	tracked, unchanged := previous.unchanged(relative, info)
+	if unchanged && (!store || utils.HasObject(tracked.Hash)) {
+		return tracked, nil
+	}
+
+	var object utils.StoredObject
+	var err error
+	if info.Mode()&os.ModeSymlink != 0 {
+		// A link is kept as its target, like git does
+		var target string
+		target, err = os.Readlink(path)
+		if err != nil {
+			return TrackedFile{}, err
+		}
+
+		if store {
+			object, err = utils.StoreReader(strings.NewReader(target))
+		} else {
+			object, err = utils.HashReader(strings.NewReader(target))
+		}
+	} else if store {
+		object, err = utils.StoreFile(path)
+	} else {
+		object, err = utils.HashFile(path)
+	}
 	if err != nil {
-		return "", err
+		return TrackedFile{}, err
 	}
-	defer file.Close()
 
-	hasher := sha256.New()
-	_, err = io.Copy(hasher, file)
+	return TrackedFile{
+		Hash:    object.Hash,
+		CRC32:   object.CRC32,
+		Size:    object.Size,
+		ModTime: info.ModTime(),
+		Mode:    info.Mode(),
+	}, nil
+}
+
+// ScanFiles hashes every file in dir that isn't ignored, without storing anything.
+func ScanFiles(dir string) ([]SnapshotFile, error) {
+	previous, err := ReadTracker(dir)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	tracker, err := scanTree(dir, previous, false)
+	if err != nil {
+		return nil, err
 	}
 
-	return hex.EncodeToString(hasher.Sum(nil)), nil
+	return tracker.snapshotFiles(), nil
 }
 
 func (sm *SnapshotManager) printChanges(changes []FileChange) error {
 	for _, change := range changes {
 		if change.Path != "" {
-			switch change.Status {
-			case Added:
-				fmt.Printf("Added: %s\n", change.Path)
-			case Modified:
-				fmt.Printf("Modified: %s\n", change.Path)
-			case Deleted:
-				fmt.Printf("Deleted: %s\n", change.Path)
-			}
+			fmt.Println(change)
 		}
 	}
+
+	if len(changes) > 0 {
+		fmt.Println()
+		WriteStat(os.Stdout, changes)
+	}
 	return nil
 }
 
+// compress writes the snapshot manifest. The file contents are stored in the
+// object store while the tree is scanned, which CreateSnapshot has usually
+// done already.
 func (sm *SnapshotManager) compress() error {
-	f, err := os.Create(filepath.Join(".", ".subsys", "snapshots", sm.Name+".zip"))
-	if err != nil {
-		fmt.Printf("Error here\n")
-	}
-	defer f.Close()
-
-	writer := zip.NewWriter(f)
-	defer writer.Close()
-
-	ignoredFiles, err := utils.GetIgnoredFiles(filepath.Join(".", "subsysignore"))
+	parent, err := LatestSnapshot()
 	if err != nil {
 		return err
 	}
 
-	err = filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+	if parent == sm.Name {
+		previous, err := LoadSnapshot(parent)
 		if err != nil {
 			return err
 		}
+		parent = previous.Parent
+	}
 
-		if !info.IsDir() && !utils.Contains(ignoredFiles, path) {
-
-			header, err := zip.FileInfoHeader(info)
-			if err != nil {
-				return err
-			}
-
-			header.Method = zip.Deflate
+	if sm.tracker == nil {
+		previous, err := ReadTracker(".")
+		if err != nil {
+			return err
+		}
 
-			header.Name, err = filepath.Rel(filepath.Dir("."), path)
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				header.Name += "/"
-			}
+		sm.tracker, err = scanFilteredTree(".", previous, true, NewFilter(sm.Include, sm.Exclude))
+		if err != nil {
+			return err
+		}
+	}
 
-			headerWriter, err := writer.CreateHeader(header)
-			if err != nil {
-				return err
-			}
+	snapshot := Snapshot{
+		Name:      sm.Name,
+		Parent:    parent,
+		CreatedAt: time.Now().UTC(),
+		Message:   sm.Message,
+		Changes:   make([]FileChange, 0),
+		Files:     sm.tracker.snapshotFiles(),
+		EmptyDirs: sm.tracker.EmptyDirs,
+		Format:    sm.Format,
+		Secrets:   sm.secrets,
+
+		Assignment:    sm.Config,
+		SubsysVersion: utils.Version,
+	}
 
-			if info.IsDir() {
-				return nil
-			}
+	for _, change := range sm.changes {
+		if change.Path != "" {
+			snapshot.Changes = append(snapshot.Changes, change)
+		}
+	}
 
-			f, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
+	for _, file := range snapshot.Files {
+		snapshot.FileCount++
+		snapshot.Size += file.Size
+	}
 
-			_, err = io.Copy(headerWriter, f)
-			return err
-		}
-		return nil
-	})
+	err = snapshot.seal()
+	if err != nil {
+		return err
+	}
 
+	err = snapshot.Save()
 	if err != nil {
 		return err
 	}
 
+	// A snapshot replaced with --force may have been made by an older version of subsys
+	err = os.Remove(LegacySnapshotPath(sm.Name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
 	return nil
 }
 
@@ -339,19 +696,54 @@ func (sm *SnapshotManager) GetSnapshotName() error {
 
 	flags := flag.NewFlagSet("snap", flag.ContinueOnError)
 	flags.StringVar(&sm.Name, "name", "", "Enter snapshot name")
+	flags.StringVar(&sm.Message, "message", "", "Describe what changed in this snapshot")
+	flags.BoolVar(&sm.Force, "force", false, "Replace an existing snapshot with the same name")
+	flags.StringVar(&sm.Format, "format", sm.Format, "Archive format to submit the snapshot in: "+strings.Join(ArchiveFormatNames(), ", "))
+	flags.BoolVar(&sm.DryRun, "dry-run", false, "List the files that would be snapped and how big the archive would be, without snapping them")
+	flags.Func("include", "Only snap files matching these patterns, separated by commas", func(patterns string) error {
+		sm.Include = append(sm.Include, splitPatterns(patterns)...)
+		return nil
+	})
+	flags.Func("exclude", "Leave out files matching these patterns, separated by commas", func(patterns string) error {
+		sm.Exclude = append(sm.Exclude, splitPatterns(patterns)...)
+		return nil
+	})
 	flags.Parse(os.Args[2:])
 
-	if !(len(sm.Name) > 0) {
+	_, err := ArchiveFormatByName(sm.Format)
+	if err != nil {
+		return err
+	}
+
+	// A dry run doesn't make a snapshot, so it needs no name
+	if sm.DryRun {
+		return nil
+	}
+
+	err = ValidateSnapshotName(sm.Name)
+	if err != nil {
+		return err
+	}
+
+	if !sm.Force && SnapshotExists(sm.Name) {
+		return fmt.Errorf("a snapshot named %s already exists, use --force to replace it", sm.Name)
+	}
+
+	fmt.Printf("The snapshot name is %v\n", sm.Name)
+	return nil
+}
+
+func ValidateSnapshotName(name string) error {
+	if !(len(name) > 0) {
 		err := errors.New("a snapshot must have a name")
 		return err
 	}
 
-	isNotSafe, _ := regexp.MatchString(`([&$\+,:;=\?@#\s<>\[\]\{\}[\/]|\\\^%])+`, sm.Name)
+	isNotSafe, _ := regexp.MatchString(`([&$\+,:;=\?@#\s<>\[\]\{\}[\/]|\\\^%])+`, name)
 	if isNotSafe {
 		err := errors.New("a snapshot's name must be a slug, refer to this https://medium.com/dailyjs/web-developer-playbook-slug-a6dcbe06c284")
 		return err
 	}
 
-	fmt.Printf("The snapshot name is %v\n", sm.Name)
 	return nil
 }
@@ -0,0 +1,205 @@
+package dirsnap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"amalitech.org/subsys/utils"
+)
+
+// ManifestName is the archive entry holding the manifest. It is written first
+// so a reader can describe an archive before going through its files.
+const ManifestName = ".subsys-manifest.json"
+
+var ErrNoManifest = errors.New("the archive has no subsys manifest")
+
+// ManifestFile is one file in an archive. A symbolic link's contents are its
+// target, and its mode marks it as a link.
+type ManifestFile struct {
+	Path   string      `json:"path"`
+	SHA256 string      `json:"sha256"`
+	Size   int64       `json:"size"`
+	Mode   os.FileMode `json:"mode,omitempty"`
+}
+
+// ArchiveManifest describes who made an archive, for which assignment, and
+// exactly which files it should contain.
+type ArchiveManifest struct {
+	Snapshot      string                 `json:"snapshot"`
+	Assignment    utils.AssignmentConfig `json:"assignment"`
+	CreatedAt     time.Time              `json:"createdAt"`
+	SubsysVersion string                 `json:"subsysVersion"`
+	Files         []ManifestFile         `json:"files"`
+	EmptyDirs     []string               `json:"emptyDirs,omitempty"`
+
+	// AllowedSecrets records that the student overrode the secret scanner,
+	// so that whoever marks the snapshot can see it.
+	AllowedSecrets []SecretFinding `json:"allowedSecrets,omitempty"`
+
+	// Signature is set by VerifyArchive once it has checked the archive's
+	// signature. It isn't part of the manifest itself.
+	Signature *ManifestSignature `json:"-"`
+}
+
+func (s *Snapshot) Manifest() ArchiveManifest {
+	name := s.Name
+	if s.ArchiveName != "" {
+		name = s.ArchiveName
+	}
+
+	manifest := ArchiveManifest{
+		Snapshot:      name,
+		Assignment:    s.Assignment,
+		CreatedAt:     s.CreatedAt,
+		SubsysVersion: s.SubsysVersion,
+		Files:         make([]ManifestFile, 0, len(s.Files)),
+		EmptyDirs:     s.EmptyDirs,
+
+		AllowedSecrets: s.Secrets,
+	}
+
+	for _, file := range s.Files {
+		manifest.Files = append(manifest.Files, ManifestFile{Path: file.Path, SHA256: file.Hash, Size: file.Size, Mode: normalizeMode(file.Mode)})
+	}
+
+	return manifest
+}
+
+func (m ArchiveManifest) String() string {
+	return fmt.Sprintf("Snapshot %s of %s by student %s for assignment %s, made %s with subsys v%s",
+		m.Snapshot, m.Assignment.ProjectName, m.Assignment.StudentID, m.Assignment.AssignmentCode,
+		m.CreatedAt.Local().Format("Mon Jan 2 15:04:05 2006"), m.SubsysVersion)
+}
+
+func writeManifest(writer ArchiveWriter, manifest ArchiveManifest) error {
+	data, err := manifest.encode()
+	if err != nil {
+		return err
+	}
+
+	return writer.WriteEntry(ArchiveEntry{
+		Name:    ManifestName,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: archiveEpoch,
+	}, bytes.NewReader(data))
+}
+
+type archivedFile struct {
+	hash string
+	size int64
+	mode os.FileMode
+	err  error
+}
+
+// VerifyArchive checks that an archive, in any of the supported formats, holds
+// exactly the files listed in its manifest, with the same contents and modes,
+// and its empty directories. A signed archive's signature must match its
+// manifest. Archives made before manifests were embedded return ErrNoManifest.
+func VerifyArchive(data []byte) (ArchiveManifest, error) {
+	var manifest ArchiveManifest
+
+	format, err := DetectArchiveFormat(data)
+	if err != nil {
+		return manifest, err
+	}
+
+	// Entries are hashed as they go by, so tarballs are only read once
+	entries := map[string]archivedFile{}
+	dirs := map[string]bool{}
+	foundManifest := false
+	var manifestData []byte
+	var signature *ManifestSignature
+	err = format.Walk(data, func(entry ArchiveEntry, contents io.Reader) error {
+		switch {
+		case entry.Mode.IsDir():
+			dirs[entry.Name] = true
+		case entry.Name == ManifestName:
+			foundManifest = true
+			data, err := io.ReadAll(contents)
+			if err == nil {
+				err = json.Unmarshal(data, &manifest)
+			}
+			if err != nil {
+				return fmt.Errorf("the archive manifest is corrupted: %v", err)
+			}
+			manifestData = data
+		case entry.Name == SignatureName:
+			signature = &ManifestSignature{}
+			err := json.NewDecoder(contents).Decode(signature)
+			if err != nil {
+				return fmt.Errorf("the archive signature is corrupted: %v", err)
+			}
+		default:
+			hasher := sha256.New()
+			size, err := io.Copy(hasher, contents)
+			entries[entry.Name] = archivedFile{hash: hex.EncodeToString(hasher.Sum(nil)), size: size, mode: entry.Mode, err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		return manifest, err
+	}
+
+	if !foundManifest {
+		return manifest, ErrNoManifest
+	}
+
+	if signature != nil {
+		err = signature.Check(manifestData)
+		if err != nil {
+			return manifest, err
+		}
+		manifest.Signature = signature
+	}
+
+	problems := []string{}
+	for _, expected := range manifest.Files {
+		file, ok := entries[expected.Path]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("missing: %s", expected.Path))
+			continue
+		}
+		delete(entries, expected.Path)
+
+		if file.err != nil {
+			problems = append(problems, fmt.Sprintf("unreadable: %s (%v)", expected.Path, file.err))
+		} else if file.hash != expected.SHA256 || file.size != expected.Size {
+			problems = append(problems, fmt.Sprintf("altered: %s", expected.Path))
+		} else if expected.Mode != 0 && !sameMode(file.mode, expected.Mode) {
+			problems = append(problems, fmt.Sprintf("altered: %s (mode %v, expected %v)", expected.Path, file.mode, expected.Mode))
+		}
+	}
+
+	for _, dir := range manifest.EmptyDirs {
+		if !dirs[dir] {
+			problems = append(problems, fmt.Sprintf("missing: %s/", dir))
+		}
+	}
+
+	for path := range entries {
+		problems = append(problems, fmt.Sprintf("unexpected: %s", path))
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return manifest, fmt.Errorf("the archive doesn't match its manifest:\n%s", strings.Join(problems, "\n"))
+	}
+
+	return manifest, nil
+}
+
+// sameMode compares what an archive can hold of a mode: whether the entry is
+// a link and its permissions.
+func sameMode(a os.FileMode, b os.FileMode) bool {
+	return a&os.ModeSymlink == b&os.ModeSymlink && a.Perm() == b.Perm()
+}
@@ -0,0 +1,241 @@
+package dirsnap
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"amalitech.org/subsys/utils"
+)
+
+// Filter narrows a snapshot down with one-off --include and --exclude
+// patterns, written like the ones in subsysignore. A nil Filter keeps every
+// file that isn't ignored.
+type Filter struct {
+	include *utils.IgnoreMatcher
+	exclude *utils.IgnoreMatcher
+}
+
+func NewFilter(include []string, exclude []string) *Filter {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil
+	}
+
+	filter := &Filter{exclude: utils.NewIgnoreMatcher(exclude)}
+	if len(include) > 0 {
+		filter.include = utils.NewIgnoreMatcher(include)
+	}
+	return filter
+}
+
+func splitPatterns(patterns string) []string {
+	split := []string{}
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern != "" {
+			split = append(split, pattern)
+		}
+	}
+	return split
+}
+
+// keepDir reports whether a directory is walked at all. Only exclusions can
+// prune one, since an included file may be anywhere inside it.
+func (f *Filter) keepDir(path string) bool {
+	return f == nil || !f.exclude.Ignored(path, true)
+}
+
+func (f *Filter) keepFile(path string) bool {
+	if f == nil {
+		return true
+	}
+	if f.exclude.Ignored(path, false) {
+		return false
+	}
+	return f.include == nil || f.include.Ignored(path, false)
+}
+
+// walked reports whether the walk reaches a path, none of the directories
+// above it being pruned.
+func (f *Filter) walked(name string) bool {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if !f.keepDir(dir) {
+			return false
+		}
+	}
+	return true
+}
+
+// narrow leaves only the part of a tracker the filter keeps, so a filtered
+// snapshot is compared with the same files it snaps.
+func (f *Filter) narrow(tracker *Tracker) *Tracker {
+	if f == nil || tracker == nil {
+		return tracker
+	}
+
+	narrowed := *tracker
+	narrowed.Files = map[string]TrackedFile{}
+	for name, file := range tracker.Files {
+		if f.walked(name) && f.keepFile(name) {
+			narrowed.Files[name] = file
+		}
+	}
+
+	narrowed.EmptyDirs = nil
+	if f.keepsEmptyDirs() {
+		for _, dir := range tracker.EmptyDirs {
+			if f.walked(dir) && f.keepDir(dir) {
+				narrowed.EmptyDirs = append(narrowed.EmptyDirs, dir)
+			}
+		}
+	}
+
+	return &narrowed
+}
+
+// keepsEmptyDirs reports whether empty directories are snapped. Including
+// only some files leaves them out, as they hold none of those files.
+func (f *Filter) keepsEmptyDirs() bool {
+	return f == nil || f.include == nil
+}
+
+// Preview lists the files a snapshot would include, how much space each
+// directory takes and roughly how big the archive would be, without storing
+// anything.
+func (sm *SnapshotManager) Preview() error {
+	format, err := ArchiveFormatByName(sm.Format)
+	if err != nil {
+		return err
+	}
+
+	previous, err := ReadTracker(".")
+	if err != nil {
+		return err
+	}
+
+	tracker, err := scanFilteredTree(".", previous, false, NewFilter(sm.Include, sm.Exclude))
+	if err != nil {
+		return err
+	}
+
+	files := tracker.snapshotFiles()
+	var size int64
+	for _, file := range files {
+		size += file.Size
+	}
+
+	fmt.Println("Files that would be snapped:")
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for _, file := range files {
+		fmt.Fprintf(table, "    %s\t  %s\t\n", utils.FormatSize(file.Size), file.Path)
+	}
+	err = table.Flush()
+	if err != nil {
+		return err
+	}
+
+	dirs := directorySizes(files)
+	if len(dirs) > 0 {
+		fmt.Println("\nSize of each directory:")
+		names := make([]string, 0, len(dirs))
+		for name := range dirs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fmt.Fprintf(table, "    %s\t  %s/\t\n", utils.FormatSize(dirs[name]), name)
+		}
+		err = table.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	compressed, err := estimateArchiveSize(format, files)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\n%d file(s), %s, about %s as a %s archive\n", len(files), utils.FormatSize(size), utils.FormatSize(compressed), format.Name())
+	fmt.Println("This was a dry run, no snapshot was made")
+	return nil
+}
+
+// directorySizes adds up the size of the files under each directory, its
+// subdirectories included.
+func directorySizes(files []SnapshotFile) map[string]int64 {
+	sizes := map[string]int64{}
+	for _, file := range files {
+		for dir := path.Dir(file.Path); dir != "."; dir = path.Dir(dir) {
+			sizes[dir] += file.Size
+		}
+	}
+	return sizes
+}
+
+type byteCounter struct {
+	size int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	return len(p), nil
+}
+
+// estimateArchiveSize compresses the working files into an archive that is
+// only counted, not kept. The manifest is left out, so the real archive is
+// slightly bigger.
+func estimateArchiveSize(format ArchiveFormat, files []SnapshotFile) (int64, error) {
+	counter := &byteCounter{}
+	writer, err := format.NewWriter(counter)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, file := range files {
+		entry := ArchiveEntry{
+			Name:    file.Path,
+			Mode:    normalizeMode(file.Mode),
+			Size:    file.Size,
+			ModTime: archiveEpoch,
+		}
+
+		err = writeWorkingFile(writer, entry, filepath.FromSlash(file.Path), file.Mode)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	return counter.size, nil
+}
+
+func writeWorkingFile(writer ArchiveWriter, entry ArchiveEntry, name string, mode os.FileMode) error {
+	var contents io.Reader
+	if mode&os.ModeSymlink != 0 {
+		target, err := os.Readlink(name)
+		if err != nil {
+			return err
+		}
+		contents = strings.NewReader(target)
+	} else {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		contents = file
+	}
+
+	return writer.WriteEntry(entry, contents)
+}
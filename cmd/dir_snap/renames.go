@@ -0,0 +1,188 @@
+package dirsnap
+
+import (
+	"sort"
+
+	"amalitech.org/subsys/utils"
+)
+
+// RenameThreshold is how similar, in percent, a deleted and an added file must
+// be to be reported as a rename.
+const RenameThreshold = 50
+
+// maxRenamePairs bounds how many added and deleted pairs are compared by
+// content, since each comparison reads both files.
+const maxRenamePairs = 10000
+
+// emptyHash is the SHA-256 of an empty file. Empty files are never taken for
+// renames or copies of each other.
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// TreeContents is one side of a comparison: each file's hash, and a way to
+// read its contents.
+type TreeContents struct {
+	Hashes map[string]string
+	Read   func(path string) ([]byte, error)
+}
+
+// DetectRenames turns added and deleted files in changes into renames and
+// copies, as git does. A file added with the contents of a deleted one is a
+// rename and with the contents of any other file a copy. Deleted and added
+// files that are still mostly alike are renames too, as long as their contents
+// can be read. The result is sorted by path.
+func DetectRenames(changes []FileChange, before TreeContents, after TreeContents) []FileChange {
+	result := make([]FileChange, 0, len(changes))
+	added, deleted := []string{}, []string{}
+
+	for _, change := range changes {
+		switch change.Status {
+		case Added:
+			added = append(added, change.Path)
+		case Deleted:
+			deleted = append(deleted, change.Path)
+		default:
+			result = append(result, change)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(deleted)
+
+	deletedByHash := map[string][]string{}
+	for _, path := range deleted {
+		hash := before.Hashes[path]
+		deletedByHash[hash] = append(deletedByHash[hash], path)
+	}
+
+	renamed := map[string]bool{}
+	remaining := []string{}
+	for _, path := range added {
+		hash := after.Hashes[path]
+		if hash == emptyHash {
+			remaining = append(remaining, path)
+			continue
+		}
+
+		if sources := deletedByHash[hash]; len(sources) > 0 {
+			result = append(result, FileChange{Path: path, Status: Renamed, From: sources[0], Similarity: 100})
+			renamed[sources[0]] = true
+			deletedByHash[hash] = sources[1:]
+			continue
+		}
+
+		if source := copySource(before.Hashes, hash); source != "" {
+			result = append(result, FileChange{Path: path, Status: Copied, From: source, Similarity: 100})
+			continue
+		}
+
+		remaining = append(remaining, path)
+	}
+
+	unmatched := []string{}
+	for _, path := range deleted {
+		if !renamed[path] {
+			unmatched = append(unmatched, path)
+		}
+	}
+
+	for _, pair := range similarPairs(unmatched, remaining, before, after) {
+		result = append(result, FileChange{Path: pair.added, Status: Renamed, From: pair.deleted, Similarity: pair.score})
+		renamed[pair.deleted] = true
+		renamed[pair.added] = true
+	}
+
+	for _, path := range remaining {
+		if !renamed[path] {
+			result = append(result, FileChange{Path: path, Status: Added})
+		}
+	}
+
+	for _, path := range unmatched {
+		if !renamed[path] {
+			result = append(result, FileChange{Path: path, Status: Deleted})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+
+	return result
+}
+
+// copySource returns the first path, in order, with the given hash.
+func copySource(hashes map[string]string, hash string) string {
+	source := ""
+	for path, candidate := range hashes {
+		if candidate == hash && (source == "" || path < source) {
+			source = path
+		}
+	}
+	return source
+}
+
+type renamePair struct {
+	deleted string
+	added   string
+	score   int
+}
+
+// similarPairs matches deleted and added files by similarity, best matches
+// first, using each file at most once.
+func similarPairs(deleted []string, added []string, before TreeContents, after TreeContents) []renamePair {
+	if len(deleted) == 0 || len(added) == 0 || len(deleted)*len(added) > maxRenamePairs {
+		return nil
+	}
+
+	contents := func(side TreeContents, paths []string) map[string][]byte {
+		read := map[string][]byte{}
+		for _, path := range paths {
+			data, err := side.Read(path)
+			if err == nil && !utils.IsBinary(data) {
+				read[path] = data
+			}
+		}
+		return read
+	}
+
+	oldContents := contents(before, deleted)
+	newContents := contents(after, added)
+
+	candidates := []renamePair{}
+	for _, oldPath := range deleted {
+		oldData, ok := oldContents[oldPath]
+		if !ok {
+			continue
+		}
+
+		for _, newPath := range added {
+			newData, ok := newContents[newPath]
+			if !ok {
+				continue
+			}
+
+			score := utils.Similarity(oldData, newData)
+			if score >= RenameThreshold {
+				candidates = append(candidates, renamePair{deleted: oldPath, added: newPath, score: score})
+			}
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	used := map[string]bool{}
+	pairs := []renamePair{}
+	for _, candidate := range candidates {
+		if used["-"+candidate.deleted] || used["+"+candidate.added] {
+			continue
+		}
+
+		used["-"+candidate.deleted] = true
+		used["+"+candidate.added] = true
+		pairs = append(pairs, candidate)
+	}
+
+	return pairs
+}
@@ -0,0 +1,262 @@
+package dirsnap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"amalitech.org/subsys/utils"
+)
+
+// AllowFile lists, with the same patterns as subsysignore, the files that may
+// be snapped even though they look like they hold secrets.
+const AllowFile = "subsysallow"
+
+// maxScanSize is the largest file scanned for secrets. Larger files are
+// datasets or build outputs rather than configuration.
+const maxScanSize = 1 << 20
+
+// minEntropy is the Shannon entropy, in bits per character, above which a long
+// token is taken for a random key rather than a word or a hex hash.
+const minEntropy = 4.5
+
+// SecretFinding is a possible secret in a snapshot. The secret itself is never
+// recorded, only where it is and what it looks like.
+type SecretFinding struct {
+	Path string `json:"path"`
+	Line int    `json:"line,omitempty"`
+	Rule string `json:"rule"`
+}
+
+func (f SecretFinding) String() string {
+	if f.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", f.Path, f.Line, f.Rule)
+	}
+	return fmt.Sprintf("%s: %s", f.Path, f.Rule)
+}
+
+type secretRule struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+var secretRules = []secretRule{
+	{"private key", regexp.MustCompile(`-----BEGIN ((RSA|DSA|EC|OPENSSH|PGP|ENCRYPTED) )?PRIVATE KEY( BLOCK)?-----`)},
+	{"AWS access key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"AWS secret key", regexp.MustCompile(`(?i)aws_secret_access_key\s*[:=]\s*["']?[A-Za-z0-9/+]{40}`)},
+	{"GitHub token", regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{40,})\b`)},
+	{"GitLab token", regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"Stripe secret key", regexp.MustCompile(`\b[rs]k_live_[0-9A-Za-z]{24,}\b`)},
+	{"API key", regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{32,}\b`)},
+}
+
+// assignment finds a quoted value given to a name that sounds secret, such as
+// password = "...".
+var assignment = regexp.MustCompile(`(?i)(password|passwd|pwd|secret|api_?key|apikey|access_?key|auth_?token|token|private_?key)["']?\s*[:=]\s*["']([^"'\s]{8,})["']`)
+
+var placeholder = regexp.MustCompile(`(?i)^(x+|\*+|\.+|changeme|change_me|your[_-].*|<.*>|\$\{.*\}|\{\{.*\}\}|%\(.*\)s|example.*|placeholder.*|dummy.*|none|null|undefined)$`)
+
+var token = regexp.MustCompile(`[A-Za-z0-9+/_-]{32,}={0,2}`)
+
+// sensitiveFiles are files that are secret whatever they hold.
+var sensitiveFiles = []struct {
+	pattern string
+	rule    string
+}{
+	{".env", "environment file"},
+	{".env.*", "environment file"},
+	{"id_rsa", "SSH private key"},
+	{"id_dsa", "SSH private key"},
+	{"id_ecdsa", "SSH private key"},
+	{"id_ed25519", "SSH private key"},
+	{"*.p12", "certificate store"},
+	{"*.pfx", "certificate store"},
+	{"*.jks", "Java keystore"},
+	{"*.keystore", "Java keystore"},
+	{".pypirc", "package registry credentials"},
+	{".netrc", "login credentials"},
+}
+
+// Templates of environment files are meant to be shared.
+var environmentTemplates = map[string]bool{".env.example": true, ".env.sample": true, ".env.template": true, ".env.dist": true}
+
+// Lock files and source maps are full of hashes that look random.
+var entropyExempt = []string{"package-lock.json", "yarn.lock", "pnpm-lock.yaml", "go.sum", "Cargo.lock", "poetry.lock", "Pipfile.lock", "composer.lock", "Gemfile.lock", "*.map", "*.min.js", "*.min.css", "*.svg"}
+
+// ScanSecrets looks through the files of a tracker that changed for secrets,
+// reading them from dir, so unchanged files aren't read again. It returns the
+// findings that block the snapshot and the ones allowed by the subsysallow
+// file. Allowed files are always scanned, as every snapshot records what they
+// hold, and every file is when subsysallow itself changed.
+func ScanSecrets(dir string, tracker *Tracker, changes []FileChange) (blocked []SecretFinding, allowed []SecretFinding, err error) {
+	allow, err := loadAllowList(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changed := map[string]bool{}
+	scanAll := false
+	for _, change := range changes {
+		if change.Path == AllowFile || (change.Status == Renamed && change.From == AllowFile) {
+			scanAll = true
+		}
+		if change.Status != Deleted {
+			changed[change.Path] = true
+		}
+	}
+
+	paths := make([]string, 0, len(tracker.Files))
+	for path := range tracker.Files {
+		if scanAll || changed[path] || allow.Ignored(path, false) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		file := tracker.Files[path]
+		if file.Mode&os.ModeSymlink != 0 {
+			continue
+		}
+
+		findings, err := scanFile(filepath.Join(dir, path), path, file.Size)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if allow.Ignored(path, false) {
+			allowed = append(allowed, findings...)
+		} else {
+			blocked = append(blocked, findings...)
+		}
+	}
+
+	return blocked, allowed, nil
+}
+
+func loadAllowList(dir string) (*utils.IgnoreMatcher, error) {
+	data, err := os.ReadFile(filepath.Join(dir, AllowFile))
+	if os.IsNotExist(err) {
+		return utils.NewIgnoreMatcher(nil), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return utils.NewIgnoreMatcher(strings.Split(string(data), "\n")), nil
+}
+
+func scanFile(fullPath string, relative string, size int64) ([]SecretFinding, error) {
+	findings := []SecretFinding{}
+
+	name := path.Base(relative)
+	for _, sensitive := range sensitiveFiles {
+		if matched, _ := path.Match(sensitive.pattern, name); matched && !environmentTemplates[name] {
+			findings = append(findings, SecretFinding{Path: relative, Rule: sensitive.rule})
+			break
+		}
+	}
+
+	if size > maxScanSize {
+		return findings, nil
+	}
+
+	data, err := os.ReadFile(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if utils.IsBinary(data) {
+		return findings, nil
+	}
+
+	checkEntropy := true
+	for _, pattern := range entropyExempt {
+		if matched, _ := path.Match(pattern, name); matched {
+			checkEntropy = false
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), maxScanSize)
+	for line := 1; scanner.Scan(); line++ {
+		rule := scanLine(scanner.Text(), checkEntropy)
+		if rule != "" {
+			findings = append(findings, SecretFinding{Path: relative, Line: line, Rule: rule})
+		}
+	}
+
+	return findings, scanner.Err()
+}
+
+// scanLine returns what kind of secret a line seems to hold, if any. Only the
+// first match is reported, one finding per line being enough to point at it.
+func scanLine(line string, checkEntropy bool) string {
+	for _, rule := range secretRules {
+		if rule.pattern.MatchString(line) {
+			return rule.name
+		}
+	}
+
+	for _, match := range assignment.FindAllStringSubmatch(line, -1) {
+		if !placeholder.MatchString(match[2]) {
+			return "hard-coded " + strings.ToLower(match[1])
+		}
+	}
+
+	if !checkEntropy {
+		return ""
+	}
+
+	for _, candidate := range token.FindAllStringIndex(line, -1) {
+		// Images and fonts embedded as data URIs
+		if strings.HasSuffix(line[:candidate[0]], "base64,") {
+			continue
+		}
+
+		if entropy(line[candidate[0]:candidate[1]]) >= minEntropy {
+			return "high-entropy token"
+		}
+	}
+
+	return ""
+}
+
+// entropy is the Shannon entropy of s in bits per character.
+func entropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, c := range s {
+		counts[c]++
+	}
+
+	result := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(len(s))
+		result -= p * math.Log2(p)
+	}
+	return result
+}
+
+// SecretsError blocks a snapshot that would include possible secrets.
+type SecretsError struct {
+	Findings []SecretFinding
+}
+
+func (e *SecretsError) Error() string {
+	var report strings.Builder
+	report.WriteString("your files look like they contain secrets, which would be submitted with the snapshot:\n")
+	for _, finding := range e.Findings {
+		report.WriteString("  " + finding.String() + "\n")
+	}
+	fmt.Fprintf(&report, "Remove the secrets or add the files to subsysignore. If they aren't secrets, add them to %s to snap them anyway, your lecturer will see that you did", AllowFile)
+	return report.String()
+}
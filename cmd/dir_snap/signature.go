@@ -0,0 +1,120 @@
+package dirsnap
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"amalitech.org/subsys/utils"
+)
+
+// SignatureName is the archive entry holding the manifest's signature,
+// written straight after the manifest.
+const SignatureName = ".subsys-manifest.sig"
+
+// ManifestSignature is an Ed25519 signature of a snapshot's manifest, exactly
+// as it is written to the archive, along with the key that made it.
+type ManifestSignature struct {
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature"`
+}
+
+// Key decodes the public key the manifest was signed with.
+func (s ManifestSignature) Key() (ed25519.PublicKey, error) {
+	return utils.DecodePublicKey(s.PublicKey)
+}
+
+// Check verifies the signature of a manifest.
+func (s ManifestSignature) Check(manifest []byte) error {
+	key, err := s.Key()
+	if err != nil {
+		return err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil || !ed25519.Verify(key, manifest, signature) {
+		return errors.New("the manifest's signature is invalid, the archive was changed after it was signed")
+	}
+
+	return nil
+}
+
+// Fingerprint is the fingerprint of the signing key, or the encoded key itself
+// when it can't be decoded.
+func (s ManifestSignature) Fingerprint() string {
+	key, err := s.Key()
+	if err != nil {
+		return s.PublicKey
+	}
+	return utils.KeyFingerprint(key)
+}
+
+func (m ArchiveManifest) encode() ([]byte, error) {
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// Sign signs the snapshot's manifest with key.
+func (s *Snapshot) Sign(key ed25519.PrivateKey) error {
+	manifest, err := s.Manifest().encode()
+	if err != nil {
+		return err
+	}
+
+	s.Signature = &ManifestSignature{
+		PublicKey: utils.EncodePublicKey(key.Public().(ed25519.PublicKey)),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, manifest)),
+	}
+	return nil
+}
+
+// seal signs the snapshot with the local key, if there is one, and records
+// the hash of its archive. It's needed again whenever the manifest changes.
+func (s *Snapshot) seal() error {
+	s.Signature = nil
+
+	key, err := utils.LoadPrivateKey()
+	if err == nil {
+		err = s.Sign(key)
+	}
+	if err != nil && !errors.Is(err, utils.ErrNoKey) {
+		return err
+	}
+
+	s.ArchiveSHA256, err = s.ArchiveHash()
+	return err
+}
+
+func writeSignature(writer ArchiveWriter, signature ManifestSignature) error {
+	data, err := json.MarshalIndent(signature, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writer.WriteEntry(ArchiveEntry{
+		Name:    SignatureName,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: archiveEpoch,
+	}, bytes.NewReader(data))
+}
+
+// CheckSigner makes sure a manifest was signed, and by the expected key.
+func (m ArchiveManifest) CheckSigner(expected string) error {
+	if m.Signature == nil {
+		return errors.New("the archive isn't signed")
+	}
+
+	want, err := utils.DecodePublicKey(expected)
+	if err != nil {
+		return err
+	}
+
+	if m.Signature.Fingerprint() != utils.KeyFingerprint(want) {
+		return fmt.Errorf("the archive was signed with key %s, not the expected %s", m.Signature.Fingerprint(), utils.KeyFingerprint(want))
+	}
+
+	return nil
+}
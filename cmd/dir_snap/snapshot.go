@@ -0,0 +1,436 @@
+package dirsnap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"amalitech.org/subsys/utils"
+)
+
+type SnapshotFile struct {
+	Path  string      `json:"path"`
+	Hash  string      `json:"hash"`
+	CRC32 uint32      `json:"crc32,omitempty"`
+	Size  int64       `json:"size"`
+	Mode  os.FileMode `json:"mode"`
+}
+
+// Snapshot is the manifest stored in .subsys/snapshots/<name>.json. The file
+// contents themselves live in the object store under .subsys/objects.
+type Snapshot struct {
+	Name      string         `json:"name"`
+	Parent    string         `json:"parent,omitempty"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Message   string         `json:"message,omitempty"`
+	FileCount int            `json:"fileCount"`
+	Size      int64          `json:"size"`
+	Changes   []FileChange   `json:"changes"`
+	Files     []SnapshotFile `json:"files"`
+	EmptyDirs []string       `json:"emptyDirs,omitempty"`
+	Format    string         `json:"format,omitempty"`
+
+	// ArchiveSHA256 is the hash of the snapshot's archive, to compare with
+	// the one the server received.
+	ArchiveSHA256 string             `json:"archiveSha256,omitempty"`
+	Signature     *ManifestSignature `json:"signature,omitempty"`
+
+	// ArchiveName is the name the snapshot was signed and archived under,
+	// when it has been renamed since.
+	ArchiveName string `json:"archiveName,omitempty"`
+
+	// Secrets are the possible secrets the student allowed into the snapshot.
+	Secrets []SecretFinding `json:"secrets,omitempty"`
+
+	Assignment    utils.AssignmentConfig `json:"assignment"`
+	SubsysVersion string                 `json:"subsysVersion,omitempty"`
+
+	SubmittedAt *time.Time `json:"submittedAt,omitempty"`
+}
+
+func SnapshotPath(name string) string {
+	return filepath.Join(".", ".subsys", "snapshots", name+".json")
+}
+
+// LegacySnapshotPath is where older versions of subsys stored a snapshot, as a
+// ready made zip archive.
+func LegacySnapshotPath(name string) string {
+	return filepath.Join(".", ".subsys", "snapshots", name+".zip")
+}
+
+func SnapshotExists(name string) bool {
+	for _, path := range []string{SnapshotPath(name), LegacySnapshotPath(name)} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func LoadSnapshot(name string) (Snapshot, error) {
+	data, err := os.ReadFile(SnapshotPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Snapshot{}, fmt.Errorf("you don't have a snapshot named %s", name)
+		}
+		return Snapshot{}, err
+	}
+
+	var snapshot Snapshot
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("snapshot %s is corrupted: %v", name, err)
+	}
+
+	return snapshot, nil
+}
+
+// ListSnapshots returns every snapshot manifest, oldest first.
+func ListSnapshots() ([]Snapshot, error) {
+	snapshots := make([]Snapshot, 0)
+
+	entries, err := os.ReadDir(filepath.Join(".", ".subsys", "snapshots"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		snapshot, err := LoadSnapshot(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt)
+	})
+
+	return snapshots, nil
+}
+
+// LatestSnapshot returns the name of the most recent snapshot, or an empty
+// string when none has been made yet.
+func LatestSnapshot() (string, error) {
+	snapshots, err := ListSnapshots()
+	if err != nil {
+		return "", err
+	}
+
+	if len(snapshots) == 0 {
+		return "", nil
+	}
+
+	return snapshots[len(snapshots)-1].Name, nil
+}
+
+// MarkSubmitted records that a snapshot has been uploaded. Snapshots made by
+// older versions of subsys have no manifest and are skipped.
+func MarkSubmitted(name string, at time.Time) error {
+	if _, err := os.Stat(SnapshotPath(name)); os.IsNotExist(err) {
+		return nil
+	}
+
+	snapshot, err := LoadSnapshot(name)
+	if err != nil {
+		return err
+	}
+
+	at = at.UTC()
+	snapshot.SubmittedAt = &at
+	return snapshot.Save()
+}
+
+// RenameSnapshot renames a snapshot and updates the snapshots made after it to
+// point at the new name. The archive keeps the name it was made with, so its
+// signature and the hash of a submission stay valid.
+func RenameSnapshot(name, newName string) error {
+	err := ValidateSnapshotName(newName)
+	if err != nil {
+		return err
+	}
+
+	if !SnapshotExists(name) {
+		return fmt.Errorf("you don't have a snapshot named %s", name)
+	}
+
+	if SnapshotExists(newName) {
+		return fmt.Errorf("a snapshot named %s already exists", newName)
+	}
+
+	if _, err := os.Stat(SnapshotPath(name)); os.IsNotExist(err) {
+		return os.Rename(LegacySnapshotPath(name), LegacySnapshotPath(newName))
+	}
+
+	snapshot, err := LoadSnapshot(name)
+	if err != nil {
+		return err
+	}
+
+	if snapshot.ArchiveName == "" {
+		snapshot.ArchiveName = name
+	}
+	if snapshot.ArchiveName == newName {
+		snapshot.ArchiveName = ""
+	}
+	snapshot.Name = newName
+
+	err = snapshot.Save()
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(SnapshotPath(name))
+	if err != nil {
+		return err
+	}
+
+	return reparent(name, newName)
+}
+
+// DeleteSnapshot removes a snapshot. Its children take its parent, so the
+// history stays connected. The objects it used are left for CollectGarbage.
+func DeleteSnapshot(name string) error {
+	if !SnapshotExists(name) {
+		return fmt.Errorf("you don't have a snapshot named %s", name)
+	}
+
+	if _, err := os.Stat(SnapshotPath(name)); os.IsNotExist(err) {
+		return os.Remove(LegacySnapshotPath(name))
+	}
+
+	snapshot, err := LoadSnapshot(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(SnapshotPath(name))
+	if err != nil {
+		return err
+	}
+
+	return reparent(name, snapshot.Parent)
+}
+
+func reparent(parent, newParent string) error {
+	snapshots, err := ListSnapshots()
+	if err != nil {
+		return err
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.Parent != parent {
+			continue
+		}
+
+		snapshot.Parent = newParent
+		err = snapshot.Save()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CollectGarbage deletes the stored objects neither a snapshot nor the tracker
+// refers to anymore, returning how many were removed and the disk space they
+// took. The tracker's objects are kept because the next snapshot reuses them
+// for the files that haven't changed.
+func CollectGarbage() (int, int64, error) {
+	snapshots, err := ListSnapshots()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tracker, err := ReadTracker(".")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	used := map[string]bool{}
+	for _, snapshot := range snapshots {
+		for _, file := range snapshot.Files {
+			used[file.Hash] = true
+		}
+	}
+	for _, file := range tracker.Files {
+		used[file.Hash] = true
+	}
+
+	return utils.PruneObjects(used)
+}
+
+// Validate checks the paths and hashes of a snapshot that was made elsewhere,
+// such as one imported from a bundle, before anything is written from it.
+func (s *Snapshot) Validate() error {
+	for _, file := range s.Files {
+		if !ValidTreePath(file.Path) {
+			return fmt.Errorf("snapshot %s contains %q, which is outside of the subsys directory", s.Name, file.Path)
+		}
+		if !utils.ValidObjectHash(file.Hash) {
+			return fmt.Errorf("snapshot %s records an invalid hash for %s", s.Name, file.Path)
+		}
+	}
+
+	for _, dir := range s.EmptyDirs {
+		if !ValidTreePath(dir) {
+			return fmt.Errorf("snapshot %s contains %q, which is outside of the subsys directory", s.Name, dir)
+		}
+	}
+
+	return nil
+}
+
+// ValidTreePath reports whether a slash separated path from a snapshot is
+// clean, relative, doesn't climb out with .. and isn't inside .subsys.
+func ValidTreePath(name string) bool {
+	if name == "" || name != path.Clean(name) || path.IsAbs(name) || strings.Contains(name, `\`) {
+		return false
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." || part == "." {
+			return false
+		}
+	}
+
+	return name != ".subsys" && !strings.HasPrefix(name, ".subsys/") && filepath.IsLocal(filepath.FromSlash(name))
+}
+
+func (s *Snapshot) Save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(SnapshotPath(s.Name), data, 0644)
+}
+
+// WriteArchive packs a snapshot from the object store in its archive format,
+// starting with its manifest. The same snapshot always gives the same bytes.
+// Formats that can take deflated objects as they are get them without
+// decompressing and compressing them again.
+func (s *Snapshot) WriteArchive(w io.Writer) error {
+	format, err := ArchiveFormatByName(s.Format)
+	if err != nil {
+		return err
+	}
+
+	writer, err := format.NewWriter(w)
+	if err != nil {
+		return err
+	}
+
+	err = writeManifest(writer, s.Manifest())
+	if err != nil {
+		return err
+	}
+
+	if s.Signature != nil {
+		err = writeSignature(writer, *s.Signature)
+		if err != nil {
+			return err
+		}
+	}
+
+	raw, canWriteRaw := writer.(rawArchiveWriter)
+	for _, file := range s.Files {
+		entry := ArchiveEntry{
+			Name:    file.Path,
+			Mode:    normalizeMode(file.Mode),
+			Size:    file.Size,
+			ModTime: archiveEpoch,
+		}
+
+		if canWriteRaw {
+			err = writeRawEntry(raw, entry, file)
+		} else {
+			// Formats that compress the whole archive
+			err = writeEntry(writer, entry, file)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range s.EmptyDirs {
+		err = writer.WriteEntry(ArchiveEntry{Name: dir, Mode: normalizeMode(os.ModeDir), ModTime: archiveEpoch}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writer.Close()
+}
+
+func (s *Snapshot) ArchiveHash() (string, error) {
+	hasher := sha256.New()
+	err := s.WriteArchive(hasher)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func writeRawEntry(writer rawArchiveWriter, entry ArchiveEntry, file SnapshotFile) error {
+	object, err := utils.OpenRawObject(file.Hash)
+	if err != nil {
+		return fmt.Errorf("missing object for %s: %v", file.Path, err)
+	}
+	defer object.Close()
+
+	info, err := object.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Snapshots made before CRCs were recorded, or by a restore that didn't
+	// keep them, don't have one. A CRC can also really be 0, in which case
+	// working it out again gives the same.
+	crc := file.CRC32
+	if crc == 0 && file.Size > 0 {
+		crc, err = objectCRC(file.Hash)
+		if err != nil {
+			return fmt.Errorf("missing object for %s: %v", file.Path, err)
+		}
+	}
+
+	return writer.WriteRawEntry(entry, crc, object, info.Size())
+}
+
+func objectCRC(hash string) (uint32, error) {
+	object, err := utils.ReadObject(hash)
+	if err != nil {
+		return 0, err
+	}
+	defer object.Close()
+
+	crc := crc32.NewIEEE()
+	_, err = io.Copy(crc, object)
+	return crc.Sum32(), err
+}
+
+func writeEntry(writer ArchiveWriter, entry ArchiveEntry, file SnapshotFile) error {
+	object, err := utils.ReadObject(file.Hash)
+	if err != nil {
+		return fmt.Errorf("missing object for %s: %v", file.Path, err)
+	}
+	defer object.Close()
+
+	return writer.WriteEntry(entry, object)
+}
@@ -0,0 +1,98 @@
+package dirsnap
+
+import (
+	"fmt"
+	"io"
+
+	"amalitech.org/subsys/utils"
+)
+
+// statGraphWidth is the most +/- characters a file gets in a stat summary.
+const statGraphWidth = 50
+
+// CountLines fills in how many lines each change inserted and deleted, or
+// marks it binary. Exact renames and copies are skipped, their contents
+// being the same on both sides. So are changes with a side that can't be read,
+// like a file tracked by an older version of subsys that never stored it, as
+// not knowing their lines is no reason to stop a snapshot.
+func CountLines(changes []FileChange, before TreeContents, after TreeContents) {
+	for i := range changes {
+		change := &changes[i]
+		if change.Similarity == 100 {
+			continue
+		}
+
+		source := change.Path
+		if change.From != "" {
+			source = change.From
+		}
+
+		var old, current []byte
+		var err error
+		if change.Status != Added {
+			old, err = before.Read(source)
+			if err != nil {
+				continue
+			}
+		}
+		if change.Status != Deleted {
+			current, err = after.Read(change.Path)
+			if err != nil {
+				continue
+			}
+		}
+
+		if utils.IsBinary(old) || utils.IsBinary(current) {
+			change.Binary = true
+			continue
+		}
+
+		lines := utils.DiffLines(utils.SplitLines(string(old)), utils.SplitLines(string(current)))
+		change.Insertions, change.Deletions = utils.DiffStat(lines)
+	}
+}
+
+// LineStat is the change's line counts like "+3 -1", "binary", or empty when
+// nothing was counted.
+func (c FileChange) LineStat() string {
+	switch {
+	case c.Binary:
+		return "binary"
+	case c.Insertions == 0 && c.Deletions == 0:
+		return ""
+	default:
+		return fmt.Sprintf("+%d -%d", c.Insertions, c.Deletions)
+	}
+}
+
+// WriteStat prints a summary of changes and their line counts, like git diff --stat.
+func WriteStat(w io.Writer, changes []FileChange) {
+	width := 0
+	for _, change := range changes {
+		if len(statPath(change)) > width {
+			width = len(statPath(change))
+		}
+	}
+
+	insertions, deletions := 0, 0
+	for _, change := range changes {
+		if change.Binary {
+			fmt.Fprintf(w, " %-*s | Bin\n", width, statPath(change))
+			continue
+		}
+
+		insertions += change.Insertions
+		deletions += change.Deletions
+		fmt.Fprintf(w, " %-*s | %d %s\n", width, statPath(change), change.Insertions+change.Deletions, utils.StatGraph(change.Insertions, change.Deletions, statGraphWidth))
+	}
+
+	fmt.Fprintf(w, " %d file(s) changed, %d insertion(s)(+), %d deletion(s)(-)\n", len(changes), insertions, deletions)
+}
+
+// statPath shows renames and copies as "from => to", like git diff --stat.
+func statPath(change FileChange) string {
+	if change.From != "" {
+		return change.From + " => " + change.Path
+	}
+	return change.Path
+}
@@ -0,0 +1,158 @@
+package dirsnap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"amalitech.org/subsys/utils"
+)
+
+const TrackerVersion = 3
+
+type TrackedFile struct {
+	Hash    string      `json:"hash"`
+	CRC32   uint32      `json:"crc32"`
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+}
+
+// Tracker is the state of the tree when the last snapshot was made, stored in
+// .subsys/.track. Keeping each file's stat lets unchanged files be skipped
+// without hashing them again.
+type Tracker struct {
+	Version   int                    `json:"version"`
+	UpdatedAt time.Time              `json:"updatedAt"`
+	Files     map[string]TrackedFile `json:"files"`
+	EmptyDirs []string               `json:"emptyDirs,omitempty"`
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		Version: TrackerVersion,
+		Files:   map[string]TrackedFile{},
+	}
+}
+
+func trackerPath(dir string) string {
+	return filepath.Join(dir, ".subsys", ".track")
+}
+
+// ReadTracker loads .subsys/.track, returning nil when there is none. Trackers
+// written by older versions of subsys, one "path hash" line per file, are
+// converted and saved in the current format the next time the tracker is written.
+func ReadTracker(dir string) (*Tracker, error) {
+	data, err := os.ReadFile(trackerPath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return NewTracker(), nil
+	}
+
+	if data[0] != '{' {
+		return readLegacyTracker(data), nil
+	}
+
+	tracker := NewTracker()
+	err = json.Unmarshal(data, tracker)
+	if err != nil {
+		return nil, fmt.Errorf("the tracker is corrupted: %v", err)
+	}
+
+	if tracker.Version > TrackerVersion {
+		return nil, fmt.Errorf("the tracker was written by a newer version of subsys (format %d)", tracker.Version)
+	}
+
+	if tracker.Files == nil {
+		tracker.Files = map[string]TrackedFile{}
+	}
+
+	return tracker, nil
+}
+
+func readLegacyTracker(data []byte) *Tracker {
+	tracker := NewTracker()
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		// The hash never contains a space, so paths that do are still read correctly
+		separator := strings.LastIndex(line, " ")
+		if separator <= 0 {
+			continue
+		}
+
+		tracker.Files[line[:separator]] = TrackedFile{Hash: line[separator+1:]}
+	}
+
+	return tracker
+}
+
+func (t *Tracker) Save(dir string) error {
+	t.Version = TrackerVersion
+	t.UpdatedAt = time.Now().UTC()
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(trackerPath(dir), data, 0644)
+}
+
+// unchanged reports whether a file can be assumed identical to its tracked
+// version from its stat alone. Files modified in the same second the tracker
+// was written are always rehashed, since a coarse mtime can't tell an edit
+// made just after the tracker was saved from one made just before.
+func (t *Tracker) unchanged(path string, info os.FileInfo) (TrackedFile, bool) {
+	tracked, ok := t.Files[path]
+	if !ok || tracked.ModTime.IsZero() || t.Version < TrackerVersion {
+		return tracked, false
+	}
+
+	return tracked, tracked.Size == info.Size() &&
+		tracked.Mode == info.Mode() &&
+		tracked.ModTime.Equal(info.ModTime()) &&
+		info.ModTime().Before(t.UpdatedAt.Truncate(time.Second))
+}
+
+// snapshotFiles lists the tracked files as snapshot entries, sorted by path.
+func (t *Tracker) snapshotFiles() []SnapshotFile {
+	files := make([]SnapshotFile, 0, len(t.Files))
+	for path, file := range t.Files {
+		files = append(files, SnapshotFile{
+			Path:  path,
+			Hash:  file.Hash,
+			CRC32: file.CRC32,
+			Size:  file.Size,
+			Mode:  file.Mode,
+		})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	return files
+}
+
+func (t *Tracker) contents(read func(path string) ([]byte, error)) TreeContents {
+	hashes := make(map[string]string, len(t.Files))
+	for path, file := range t.Files {
+		hashes[path] = file.Hash
+	}
+
+	return TreeContents{Hashes: hashes, Read: read}
+}
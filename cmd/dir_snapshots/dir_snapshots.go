@@ -0,0 +1,266 @@
+package dirsnapshots
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+	"amalitech.org/subsys/utils"
+)
+
+const dateFormat = "Mon Jan 2 15:04:05 2006"
+
+type SnapshotsManager struct {
+	Config utils.AssignmentConfig
+	Keep   int
+	DryRun bool
+	Output io.Writer
+}
+
+func NewSnapshotsManager() *SnapshotsManager {
+	config, err := utils.GetConfig()
+	if err != nil {
+		log.Fatalf("Couldn't get config file: %v \n", err)
+		return nil
+	}
+
+	return &SnapshotsManager{
+		Config: config,
+		Output: os.Stdout,
+	}
+}
+
+func (sm *SnapshotsManager) ManageSnapshots() error {
+	if len(os.Args) < 3 {
+		return errors.New("specify what to do: list, show, rename, rm or prune")
+	}
+
+	flags := flag.NewFlagSet("snapshots "+os.Args[2], flag.ContinueOnError)
+	flags.IntVar(&sm.Keep, "keep", 5, "Number of recent snapshots prune keeps")
+	flags.BoolVar(&sm.DryRun, "dry-run", false, "Show what prune would remove without removing it")
+
+	args, err := utils.ParseInterspersed(flags, os.Args[3:])
+	if err != nil {
+		return err
+	}
+
+	switch os.Args[2] {
+	case "list":
+		return sm.List()
+	case "show":
+		if len(args) != 1 {
+			return errors.New("usage: subsys snapshots show <name>")
+		}
+		return sm.Show(args[0])
+	case "rename":
+		if len(args) != 2 {
+			return errors.New("usage: subsys snapshots rename <name> <new-name>")
+		}
+		return sm.Rename(args[0], args[1])
+	case "rm":
+		if len(args) == 0 {
+			return errors.New("usage: subsys snapshots rm <name>...")
+		}
+		return sm.Remove(args)
+	case "prune":
+		return sm.Prune()
+	default:
+		return fmt.Errorf("unknown snapshots command %s, use list, show, rename, rm or prune", os.Args[2])
+	}
+}
+
+// List prints every snapshot, oldest first. Snapshots made by older versions
+// of subsys are listed from their zip, which records no file count or date.
+func (sm *SnapshotsManager) List() error {
+	snapshots, err := dirsnap.ListSnapshots()
+	if err != nil {
+		return err
+	}
+
+	legacy, err := legacySnapshots()
+	if err != nil {
+		return err
+	}
+
+	if len(snapshots) == 0 && len(legacy) == 0 {
+		fmt.Fprintln(sm.Output, "You have no snapshots yet, first create a snapshot with the subsys snap command")
+		return nil
+	}
+
+	table := tabwriter.NewWriter(sm.Output, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tDATE\tFILES\tSIZE\tSUBMITTED")
+
+	for _, info := range legacy {
+		name := strings.TrimSuffix(info.Name(), ".zip")
+		fmt.Fprintf(table, "%s\t%s\t-\t%s\t-\n", name, info.ModTime().Format(dateFormat), utils.FormatSize(info.Size()))
+	}
+
+	for _, snapshot := range snapshots {
+		submitted := "no"
+		if snapshot.SubmittedAt != nil {
+			submitted = snapshot.SubmittedAt.Local().Format(dateFormat)
+		}
+
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\t%s\n", snapshot.Name, snapshot.CreatedAt.Local().Format(dateFormat),
+			snapshot.FileCount, utils.FormatSize(snapshot.Size), submitted)
+	}
+
+	return table.Flush()
+}
+
+func (sm *SnapshotsManager) Show(name string) error {
+	snapshot, err := dirsnap.LoadSnapshot(name)
+	if err != nil {
+		if _, statErr := os.Stat(dirsnap.LegacySnapshotPath(name)); statErr == nil {
+			return fmt.Errorf("snapshot %s was made by an older version of subsys and has no details to show", name)
+		}
+		return err
+	}
+
+	fmt.Fprintf(sm.Output, "snapshot %s\n", snapshot.Name)
+	if snapshot.Parent != "" {
+		fmt.Fprintf(sm.Output, "Parent:     %s\n", snapshot.Parent)
+	}
+	fmt.Fprintf(sm.Output, "Date:       %s\n", snapshot.CreatedAt.Local().Format(dateFormat))
+	if snapshot.Assignment.AssignmentCode != "" {
+		fmt.Fprintf(sm.Output, "Assignment: %s\n", snapshot.Assignment.AssignmentCode)
+	}
+	if snapshot.Assignment.StudentID != "" {
+		fmt.Fprintf(sm.Output, "Student:    %s\n", snapshot.Assignment.StudentID)
+	}
+	if snapshot.SubmittedAt != nil {
+		fmt.Fprintf(sm.Output, "Submitted:  %s\n", snapshot.SubmittedAt.Local().Format(dateFormat))
+	} else {
+		fmt.Fprintln(sm.Output, "Submitted:  no")
+	}
+	fmt.Fprintf(sm.Output, "Files:      %d (%s)\n", snapshot.FileCount, utils.FormatSize(snapshot.Size))
+	if snapshot.Format != "" {
+		fmt.Fprintf(sm.Output, "Format:     %s\n", snapshot.Format)
+	}
+	if snapshot.ArchiveSHA256 != "" {
+		fmt.Fprintf(sm.Output, "SHA-256:    %s\n", snapshot.ArchiveSHA256)
+	}
+	if snapshot.Signature != nil {
+		fmt.Fprintf(sm.Output, "Signed by:  %s\n", snapshot.Signature.Fingerprint())
+	}
+	for _, finding := range snapshot.Secrets {
+		fmt.Fprintf(sm.Output, "Allowed:    %s\n", finding)
+	}
+
+	if snapshot.Message != "" {
+		fmt.Fprintf(sm.Output, "\n    %s\n", snapshot.Message)
+	}
+
+	fmt.Fprintln(sm.Output)
+	table := tabwriter.NewWriter(sm.Output, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for _, file := range snapshot.Files {
+		fmt.Fprintf(table, "    %s\t  %s\t\n", utils.FormatSize(file.Size), file.Path)
+	}
+
+	return table.Flush()
+}
+
+func (sm *SnapshotsManager) Rename(name, newName string) error {
+	err := dirsnap.RenameSnapshot(name, newName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(sm.Output, "Renamed snapshot %s to %s\n", name, newName)
+	return nil
+}
+
+func (sm *SnapshotsManager) Remove(names []string) error {
+	for _, name := range names {
+		if !dirsnap.SnapshotExists(name) {
+			return fmt.Errorf("you don't have a snapshot named %s", name)
+		}
+	}
+
+	for _, name := range names {
+		err := dirsnap.DeleteSnapshot(name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sm.Output, "Removed snapshot %s\n", name)
+	}
+
+	return sm.collectGarbage()
+}
+
+// Prune removes old snapshots, keeping the Keep most recent ones and every
+// snapshot that was submitted. Snapshots made by older versions of subsys
+// aren't touched, since whether they were submitted isn't known.
+func (sm *SnapshotsManager) Prune() error {
+	if sm.Keep < 0 {
+		return errors.New("--keep can't be negative")
+	}
+
+	snapshots, err := dirsnap.ListSnapshots()
+	if err != nil {
+		return err
+	}
+
+	pruned := []string{}
+	for i, snapshot := range snapshots {
+		if i >= len(snapshots)-sm.Keep || snapshot.SubmittedAt != nil {
+			continue
+		}
+		pruned = append(pruned, snapshot.Name)
+	}
+
+	if len(pruned) == 0 {
+		fmt.Fprintln(sm.Output, "Nothing to prune")
+		return nil
+	}
+
+	if sm.DryRun {
+		for _, name := range pruned {
+			fmt.Fprintf(sm.Output, "Would remove snapshot %s\n", name)
+		}
+		return nil
+	}
+
+	return sm.Remove(pruned)
+}
+
+func (sm *SnapshotsManager) collectGarbage() error {
+	removed, freed, err := dirsnap.CollectGarbage()
+	if err != nil {
+		return err
+	}
+
+	if removed > 0 {
+		fmt.Fprintf(sm.Output, "Removed %d unused object(s), freeing %s\n", removed, utils.FormatSize(freed))
+	}
+	return nil
+}
+
+func legacySnapshots() ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(filepath.Join(".", ".subsys", "snapshots"))
+	if err != nil {
+		return nil, err
+	}
+
+	legacy := []os.FileInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".zip" {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		legacy = append(legacy, info)
+	}
+
+	return legacy, nil
+}
@@ -0,0 +1,256 @@
+package dirsnapshots
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dirinit "amalitech.org/subsys/cmd/dir_init"
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+	"amalitech.org/subsys/utils"
+)
+
+func SetupSnapshotsTests(t *testing.T) *SnapshotsManager {
+	tempDir := t.TempDir()
+
+	err := os.Chdir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to change working directory: %v", err)
+	}
+
+	initializer, err := dirinit.NewDirectoryInitializer()
+	if err != nil {
+		t.Fatalf("NewDirectoryInitializer failed: %v", err)
+	}
+
+	err = initializer.Initialize()
+	if err != nil {
+		t.Fatalf("InitializeDirectory failed: %v", err)
+	}
+
+	for i, name := range []string{"first", "second", "third"} {
+		os.WriteFile("main.py", []byte(strings.Repeat("print('hello')\n", i+1)), 0644)
+
+		os.Args = []string{"program", "snap", "--name", name}
+		err = dirsnap.NewSnapshotManager().CreateSnapshot()
+		if err != nil {
+			t.Fatalf("Error creating snapshot: %v", err)
+		}
+	}
+
+	sm := NewSnapshotsManager()
+	sm.Output = &bytes.Buffer{}
+	return sm
+}
+
+func objectCount(t *testing.T) int {
+	count := 0
+	filepath.Walk(filepath.Join(".subsys", "objects"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+func TestList(t *testing.T) {
+	sm := SetupSnapshotsTests(t)
+
+	err := dirsnap.MarkSubmitted("second", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(dirsnap.LegacySnapshotPath("old"), []byte("zip"), 0644)
+
+	err = sm.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(sm.Output.(*bytes.Buffer).String()), "\n")
+	if len(lines) != 5 || !strings.HasPrefix(lines[0], "NAME") {
+		t.Fatalf("Expected a header and 4 snapshots, got %q", lines)
+	}
+
+	if !strings.HasPrefix(lines[1], "old ") || !strings.HasPrefix(lines[2], "first ") || !strings.HasPrefix(lines[4], "third ") {
+		t.Errorf("Expected legacy snapshots first then oldest first, got %q", lines)
+	}
+
+	if !strings.HasSuffix(lines[2], "no") || strings.HasSuffix(lines[3], "no") {
+		t.Errorf("Expected only second to be submitted, got %q", lines)
+	}
+}
+
+func TestShow(t *testing.T) {
+	sm := SetupSnapshotsTests(t)
+
+	err := sm.Show("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := sm.Output.(*bytes.Buffer).String()
+	for _, expected := range []string{"snapshot second", "Parent:     first", "Submitted:  no", "Files:      1 (", "main.py"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected output to contain %q, got %q", expected, output)
+		}
+	}
+
+	err = sm.Show("missing")
+	if err == nil {
+		t.Errorf("Expected an error showing a missing snapshot")
+	}
+}
+
+func TestRename(t *testing.T) {
+	sm := SetupSnapshotsTests(t)
+
+	err := sm.Rename("second", "draft")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dirsnap.SnapshotExists("second") || !dirsnap.SnapshotExists("draft") {
+		t.Fatalf("Expected second to be renamed to draft")
+	}
+
+	third, err := dirsnap.LoadSnapshot("third")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Parent != "draft" {
+		t.Errorf("Expected third's parent to be draft, got %s", third.Parent)
+	}
+
+	err = sm.Rename("first", "third")
+	if err == nil {
+		t.Errorf("Expected an error renaming to an existing snapshot")
+	}
+
+	err = sm.Rename("first", "not a slug")
+	if err == nil {
+		t.Errorf("Expected an error renaming to an invalid name")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	sm := SetupSnapshotsTests(t)
+
+	before := objectCount(t)
+
+	err := sm.Remove([]string{"second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dirsnap.SnapshotExists("second") {
+		t.Fatalf("Expected second to be removed")
+	}
+
+	third, err := dirsnap.LoadSnapshot("third")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Parent != "first" {
+		t.Errorf("Expected third's parent to be first, got %s", third.Parent)
+	}
+
+	if objectCount(t) != before-1 {
+		t.Errorf("Expected the object only second used to be removed, had %d objects and now %d", before, objectCount(t))
+	}
+
+	// The remaining snapshots must still be complete
+	for _, name := range []string{"first", "third"} {
+		snapshot, err := dirsnap.LoadSnapshot(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range snapshot.Files {
+			if !utils.HasObject(file.Hash) {
+				t.Errorf("Snapshot %s lost the object for %s", name, file.Path)
+			}
+		}
+	}
+
+	err = sm.Remove([]string{"first", "missing"})
+	if err == nil || !dirsnap.SnapshotExists("first") {
+		t.Errorf("Expected nothing to be removed when one of the snapshots doesn't exist")
+	}
+}
+
+func TestRemoveLatestKeepsTrackedObjects(t *testing.T) {
+	sm := SetupSnapshotsTests(t)
+
+	os.WriteFile("main.py", []byte(strings.Repeat("print('hello')\n", 4)), 0644)
+	os.Args = []string{"program", "snap", "--name", "fourth"}
+	err := dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	err = sm.Remove([]string{"fourth"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tracker still records fourth's files, so their objects are kept
+	tracker, err := dirsnap.ReadTracker(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, file := range tracker.Files {
+		if !utils.HasObject(file.Hash) {
+			t.Errorf("Expected the tracked object for %s to be kept", path)
+		}
+	}
+
+	os.WriteFile("main.py", []byte(strings.Repeat("print('hello')\n", 5)), 0644)
+	os.Args = []string{"program", "snap", "--name", "fifth"}
+	err = dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Expected a snapshot after removing the latest one, got %v", err)
+	}
+
+	fifth, err := dirsnap.LoadSnapshot("fifth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fifth.Changes) != 1 || fifth.Changes[0].LineStat() != "+1 -0" {
+		t.Errorf("Expected main.py to gain a line since the tracker, got %+v", fifth.Changes)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	sm := SetupSnapshotsTests(t)
+
+	err := dirsnap.MarkSubmitted("first", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sm.Keep = 1
+	sm.DryRun = true
+	err = sm.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := sm.Output.(*bytes.Buffer).String()
+	if output != "Would remove snapshot second\n" || !dirsnap.SnapshotExists("second") {
+		t.Fatalf("Expected a dry run to only report second, got %q", output)
+	}
+
+	sm.DryRun = false
+	err = sm.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !dirsnap.SnapshotExists("first") || dirsnap.SnapshotExists("second") || !dirsnap.SnapshotExists("third") {
+		t.Errorf("Expected prune to keep the submitted first and the latest third snapshot")
+	}
+}
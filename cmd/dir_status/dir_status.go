@@ -0,0 +1,90 @@
+package dirstatus
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+	"amalitech.org/subsys/utils"
+)
+
+type StatusManager struct {
+	Config utils.AssignmentConfig
+	Output io.Writer
+}
+
+func NewStatusManager() *StatusManager {
+	config, err := utils.GetConfig()
+	if err != nil {
+		log.Fatalf("Couldn't get config file: %v \n", err)
+		return nil
+	}
+
+	return &StatusManager{
+		Config: config,
+		Output: os.Stdout,
+	}
+}
+
+// ShowStatus prints the changes made since the last snapshot. Unlike snap it
+// never writes the tracker or stores anything.
+func (st *StatusManager) ShowStatus() error {
+	latest, err := dirsnap.LatestSnapshot()
+	if err != nil {
+		return err
+	}
+
+	if latest == "" {
+		fmt.Fprintln(st.Output, "No snapshots yet")
+	} else {
+		snapshot, err := dirsnap.LoadSnapshot(latest)
+		if err != nil {
+			return err
+		}
+
+		if snapshot.SubmittedAt != nil {
+			fmt.Fprintf(st.Output, "Latest snapshot: %s (submitted %s)\n", latest, snapshot.SubmittedAt.Local().Format("Mon Jan 2 15:04:05 2006"))
+		} else {
+			fmt.Fprintf(st.Output, "Latest snapshot: %s (not submitted)\n", latest)
+		}
+	}
+
+	sm := &dirsnap.SnapshotManager{Config: st.Config}
+	changes, err := sm.PendingChanges(".")
+	if err != nil {
+		return err
+	}
+
+	groups := map[dirsnap.Status][]string{}
+	for _, change := range changes {
+		if change.Path != "" {
+			groups[change.Status] = append(groups[change.Status], change.Label())
+		}
+	}
+
+	if len(groups) == 0 {
+		fmt.Fprintln(st.Output, "\nNothing to snap, your files match the latest snapshot")
+		return nil
+	}
+
+	fmt.Fprintln(st.Output, "\nChanges not yet snapped:")
+	fmt.Fprintln(st.Output, "  (use \"subsys snap --name <name>\" to snapshot them)")
+
+	for _, status := range []dirsnap.Status{dirsnap.Added, dirsnap.Modified, dirsnap.Deleted, dirsnap.Renamed, dirsnap.Copied} {
+		paths := groups[status]
+		if len(paths) == 0 {
+			continue
+		}
+
+		sort.Strings(paths)
+		fmt.Fprintf(st.Output, "\n%s:\n", status)
+		for _, path := range paths {
+			fmt.Fprintf(st.Output, "\t%s\n", path)
+		}
+	}
+
+	return nil
+}
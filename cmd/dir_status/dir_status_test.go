@@ -0,0 +1,106 @@
+package dirstatus
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dirinit "amalitech.org/subsys/cmd/dir_init"
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+)
+
+func SetupStatusTests(t *testing.T) *StatusManager {
+	tempDir := t.TempDir()
+
+	err := os.Chdir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to change working directory: %v", err)
+	}
+
+	initializer, err := dirinit.NewDirectoryInitializer()
+	if err != nil {
+		t.Fatalf("NewDirectoryInitializer failed: %v", err)
+	}
+
+	err = initializer.Initialize()
+	if err != nil {
+		t.Fatalf("InitializeDirectory failed: %v", err)
+	}
+
+	os.WriteFile("main.py", []byte("print('hello')"), 0644)
+	os.WriteFile("old.txt", []byte("old"), 0644)
+
+	os.Args = []string{"program", "snap", "--name", "first"}
+	err = dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	sm := NewStatusManager()
+	sm.Output = &bytes.Buffer{}
+	return sm
+}
+
+func TestShowStatus(t *testing.T) {
+	st := SetupStatusTests(t)
+
+	os.WriteFile("main.py", []byte("print('hello world')"), 0644)
+	os.WriteFile("new.txt", []byte("new"), 0644)
+	os.Remove("old.txt")
+
+	tracker, err := os.ReadFile(filepath.Join(".subsys", ".track"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = st.ShowStatus()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	output := st.Output.(*bytes.Buffer).String()
+	for _, expected := range []string{
+		"Latest snapshot: first (not submitted)",
+		"Added:\n\tnew.txt\n",
+		"Modified:\n\tmain.py\n",
+		"Deleted:\n\told.txt\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected status to contain %q, got:\n%s", expected, output)
+		}
+	}
+
+	after, err := os.ReadFile(filepath.Join(".subsys", ".track"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tracker, after) {
+		t.Error("Expected status to leave the tracker untouched")
+	}
+}
+
+func TestShowStatusClean(t *testing.T) {
+	st := SetupStatusTests(t)
+
+	err := dirsnap.MarkSubmitted("first", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = st.ShowStatus()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	output := st.Output.(*bytes.Buffer).String()
+	if !strings.Contains(output, "Latest snapshot: first (submitted") {
+		t.Errorf("Expected the latest snapshot to be shown as submitted, got:\n%s", output)
+	}
+
+	if !strings.Contains(output, "Nothing to snap") {
+		t.Errorf("Expected no pending changes, got:\n%s", output)
+	}
+}
@@ -2,6 +2,8 @@ package dirsubmission
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -13,7 +15,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
 	"amalitech.org/subsys/utils"
 )
 
@@ -84,7 +88,13 @@ func NewSubmissionInitializer() *SubmissionManager {
 }
 
 func (sm *SubmissionManager) SubmitSnapshots() error {
-	err := sm.Login()
+	// An empty snapshot name means every snapshot is submitted
+	err := utils.RunHook(".", utils.PreSubmitHook, ".", map[string]string{"SNAPSHOT": sm.SnapshotName})
+	if err != nil {
+		return err
+	}
+
+	err = sm.Login()
 	if err != nil {
 		return err
 	}
@@ -116,29 +126,43 @@ func (sm *SubmissionManager) Submit() error {
 	fileFound := false
 	validSnapshots := []string{}
 	submittedSnaphots := []string{}
+	archiveHashes := []string{}
+	signatures := map[string]string{}
 	err := filepath.Walk(filepath.Join(".", ".subsys", "snapshots"), func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() && filepath.Ext(path) == ".zip" {
-
-			fileName := strings.Split(info.Name(), ".")[0]
-			validSnapshots = append(validSnapshots, fileName)
-
-			if fileName == sm.SnapshotName || sm.SnapshotName == "" {
-				fileFound = true
-				file, err := os.Open(path)
-				if err != nil {
-					return err
-				}
-				defer file.Close()
-
-				formFile, err := writer.CreateFormFile("snapshotArchive", filepath.Base(path))
-				if err != nil {
-					return err
-				}
-				_, err = io.Copy(formFile, file)
-				if err != nil {
-					return err
-				}
-				submittedSnaphots = append(submittedSnaphots, fileName)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || (filepath.Ext(path) != ".json" && filepath.Ext(path) != ".zip") {
+			return nil
+		}
+
+		fileName := strings.TrimSuffix(info.Name(), filepath.Ext(path))
+		validSnapshots = append(validSnapshots, fileName)
+
+		if fileName == sm.SnapshotName || sm.SnapshotName == "" {
+			fileFound = true
+
+			uploadName := fileName + archiveExtension(path)
+			if sm.Config.LecturerKey != "" {
+				uploadName += utils.EncryptedExtension
+			}
+
+			formFile, err := writer.CreateFormFile("snapshotArchive", uploadName)
+			if err != nil {
+				return err
+			}
+
+			hash, err := sm.writeUpload(path, formFile)
+			if err != nil {
+				return err
+			}
+			submittedSnaphots = append(submittedSnaphots, fileName)
+			archiveHashes = append(archiveHashes, hash)
+
+			signature := sm.signature(path)
+			if signature != nil {
+				signatures[fileName] = signature.Signature
 			}
 		}
 		return nil
@@ -147,6 +171,26 @@ func (sm *SubmissionManager) Submit() error {
 		return err
 	}
 
+	// The server keeps the key and signatures to check the archives against later
+	if sm.Config.PublicKey != "" {
+		err = writer.WriteField("publicKey", sm.Config.PublicKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(signatures) > 0 {
+		data, err := json.Marshal(signatures)
+		if err != nil {
+			return err
+		}
+
+		err = writer.WriteField("signatures", string(data))
+		if err != nil {
+			return err
+		}
+	}
+
 	err = writer.Close()
 	if err != nil {
 		return nil
@@ -158,7 +202,7 @@ func (sm *SubmissionManager) Submit() error {
 	}
 
 	if len(submittedSnaphots) == 0 {
-		log.Fatal("You have no snapshots yet, first create a snapshot with the subsys snap command")
+		return errors.New("you have no snapshots yet, first create a snapshot with the subsys snap command")
 	}
 
 	client := &http.Client{}
@@ -189,7 +233,20 @@ func (sm *SubmissionManager) Submit() error {
 
 	sm.success = true
 
+	for _, name := range submittedSnaphots {
+		err = dirsnap.MarkSubmitted(name, time.Now())
+		if err != nil {
+			fmt.Printf("Couldn't record that %s was submitted: %v\n", name, err)
+		}
+	}
+
 	fmt.Printf("Submitted snapshot(s): %v\n", strings.Join(submittedSnaphots, ","))
+	for i, name := range submittedSnaphots {
+		fmt.Printf("Archive SHA-256 of %s: %s\n", name, archiveHashes[i])
+	}
+	if sm.Config.LecturerKey != "" {
+		fmt.Println("The archives were encrypted to your lecturer's key, the hashes are of the archives before encryption")
+	}
 
 	var response SubmissionResponse
 	json.Unmarshal(body, &response)
@@ -198,3 +255,100 @@ func (sm *SubmissionManager) Submit() error {
 
 	return nil
 }
+
+// archiveExtension is the extension of the archive a snapshot is submitted as.
+func archiveExtension(path string) string {
+	if filepath.Ext(path) == ".zip" {
+		return ".zip"
+	}
+
+	snapshot, err := dirsnap.LoadSnapshot(strings.TrimSuffix(filepath.Base(path), ".json"))
+	if err != nil {
+		return ".zip"
+	}
+
+	format, err := dirsnap.ArchiveFormatByName(snapshot.Format)
+	if err != nil {
+		return ".zip"
+	}
+
+	return format.Extension()
+}
+
+// signature returns a snapshot's signature, warning when it's missing or
+// wasn't made with the registered key.
+func (sm *SubmissionManager) signature(path string) *dirsnap.ManifestSignature {
+	if filepath.Ext(path) != ".json" {
+		return nil
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), ".json")
+	snapshot, err := dirsnap.LoadSnapshot(name)
+	if err != nil {
+		return nil
+	}
+
+	if snapshot.Signature == nil {
+		if sm.Config.PublicKey != "" {
+			fmt.Printf("Warning: snapshot %s isn't signed\n", name)
+		}
+		return nil
+	}
+
+	if snapshot.Signature.PublicKey != sm.Config.PublicKey {
+		fmt.Printf("Warning: snapshot %s was signed with key %s, which isn't your registered key\n", name, snapshot.Signature.Fingerprint())
+	}
+
+	return snapshot.Signature
+}
+
+// writeUpload writes a snapshot's archive, encrypted to the lecturer's key if
+// there is one, and returns the SHA-256 of the archive before encryption.
+func (sm *SubmissionManager) writeUpload(path string, w io.Writer) (string, error) {
+	hasher := sha256.New()
+	if sm.Config.LecturerKey == "" {
+		err := sm.writeArchive(path, io.MultiWriter(w, hasher))
+		return hex.EncodeToString(hasher.Sum(nil)), err
+	}
+
+	recipient, err := utils.DecodeRecipient(sm.Config.LecturerKey)
+	if err != nil {
+		return "", err
+	}
+
+	var archive bytes.Buffer
+	err = sm.writeArchive(path, io.MultiWriter(&archive, hasher))
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := utils.Encrypt(archive.Bytes(), recipient)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = w.Write(sealed)
+	return hex.EncodeToString(hasher.Sum(nil)), err
+}
+
+// writeArchive builds the archive for a snapshot manifest from the object store, in the snapshot's format.
+// Snapshots made by older versions of subsys are already zips and are sent as is.
+func (sm *SubmissionManager) writeArchive(path string, w io.Writer) error {
+	if filepath.Ext(path) == ".zip" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(w, file)
+		return err
+	}
+
+	snapshot, err := dirsnap.LoadSnapshot(strings.TrimSuffix(filepath.Base(path), ".json"))
+	if err != nil {
+		return err
+	}
+
+	return snapshot.WriteArchive(w)
+}
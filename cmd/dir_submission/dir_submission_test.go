@@ -1,6 +1,7 @@
 package dirsubmission
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -10,6 +11,7 @@ import (
 
 	dirconfig "amalitech.org/subsys/cmd/dir_config"
 	dirinit "amalitech.org/subsys/cmd/dir_init"
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
 	"amalitech.org/subsys/utils"
 )
 
@@ -149,3 +151,215 @@ func TestSubmitSnapshotSuccess(t *testing.T) {
 		t.Errorf("Expected success to be: %v, got %v", expectedResult, got)
 	}
 }
+
+func TestSubmitManifestSnapshot(t *testing.T) {
+	var uploaded string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, header, err := r.FormFile("snapshotArchive")
+		if err != nil {
+			t.Errorf("Expected a snapshot archive in the request: %v", err)
+		} else {
+			uploaded = header.Filename
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"message": "Submission successful"}`))
+	}))
+	defer server.Close()
+
+	sm := SetupSubmissionTests(t)
+	sm.ServerUrl = server.URL
+
+	os.WriteFile("main.py", []byte("print('hello')"), 0644)
+	os.Args = []string{"program", "snap", "--name", "test"}
+	err := dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	err = sm.Submit()
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if uploaded != "test.zip" {
+		t.Errorf("Expected test.zip to be uploaded, got %q", uploaded)
+	}
+
+	snapshot, err := dirsnap.LoadSnapshot("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.SubmittedAt == nil {
+		t.Error("Expected the snapshot to be marked as submitted")
+	}
+}
+
+func TestSubmitTarSnapshot(t *testing.T) {
+	var uploaded string
+	var archive []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, header, err := r.FormFile("snapshotArchive")
+		if err != nil {
+			t.Errorf("Expected a snapshot archive in the request: %v", err)
+		} else {
+			uploaded = header.Filename
+			archive, _ = io.ReadAll(file)
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"message": "Submission successful"}`))
+	}))
+	defer server.Close()
+
+	sm := SetupSubmissionTests(t)
+	sm.ServerUrl = server.URL
+
+	os.WriteFile("main.py", []byte("print('hello')"), 0644)
+	os.Args = []string{"program", "snap", "--name", "test", "--format", "tar.zst"}
+	err := dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	err = sm.Submit()
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if uploaded != "test.tar.zst" {
+		t.Errorf("Expected test.tar.zst to be uploaded, got %q", uploaded)
+	}
+
+	_, err = dirsnap.VerifyArchive(archive)
+	if err != nil {
+		t.Errorf("Expected the uploaded archive to verify, got %v", err)
+	}
+}
+
+func TestSubmitSignedSnapshot(t *testing.T) {
+	var publicKey, signatures string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseMultipartForm(1 << 20)
+		publicKey = r.FormValue("publicKey")
+		signatures = r.FormValue("signatures")
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"message": "Submission successful"}`))
+	}))
+	defer server.Close()
+
+	sm := SetupSubmissionTests(t)
+	sm.ServerUrl = server.URL
+
+	key, err := utils.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	sm.Config.PublicKey = utils.EncodePublicKey(key)
+
+	os.WriteFile("main.py", []byte("print('hello')"), 0644)
+	os.Args = []string{"program", "snap", "--name", "test"}
+	err = dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	err = sm.Submit()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	snapshot, _ := dirsnap.LoadSnapshot("test")
+	if publicKey != sm.Config.PublicKey {
+		t.Errorf("Expected the registered public key to be sent, got %q", publicKey)
+	}
+	if !strings.Contains(signatures, `"test":"`+snapshot.Signature.Signature+`"`) {
+		t.Errorf("Expected the snapshot's signature to be sent, got %q", signatures)
+	}
+}
+
+func TestSubmitEncryptedSnapshot(t *testing.T) {
+	var uploaded string
+	var archive []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, header, err := r.FormFile("snapshotArchive")
+		if err != nil {
+			t.Errorf("Expected a snapshot archive in the request: %v", err)
+		} else {
+			uploaded = header.Filename
+			archive, _ = io.ReadAll(file)
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"message": "Submission successful"}`))
+	}))
+	defer server.Close()
+
+	sm := SetupSubmissionTests(t)
+	sm.ServerUrl = server.URL
+
+	identity := filepath.Join(t.TempDir(), "lecturer.key")
+	public, err := utils.GenerateIdentity(identity)
+	if err != nil {
+		t.Fatalf("GenerateIdentity failed: %v", err)
+	}
+	sm.Config.LecturerKey = public
+
+	os.WriteFile("main.py", []byte("print('hello')"), 0644)
+	os.Args = []string{"program", "snap", "--name", "test"}
+	err = dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	err = sm.Submit()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if uploaded != "test.zip.enc" || !utils.IsEncrypted(archive) {
+		t.Fatalf("Expected an encrypted test.zip.enc to be uploaded, got %q", uploaded)
+	}
+
+	key, _ := utils.LoadIdentity(identity)
+	plain, err := utils.Decrypt(archive, key)
+	if err != nil {
+		t.Fatalf("Expected the lecturer's key to decrypt the upload: %v", err)
+	}
+
+	manifest, err := dirsnap.VerifyArchive(plain)
+	if err != nil || manifest.Snapshot != "test" {
+		t.Errorf("Expected the decrypted archive to verify, got %+v, %v", manifest, err)
+	}
+}
+
+func TestPreSubmitHook(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"message": "Submission successful"}`))
+	}))
+	defer server.Close()
+
+	sm := SetupSubmissionTests(t)
+	sm.ServerUrl = server.URL
+
+	os.MkdirAll(utils.HooksPath("."), 0777)
+	hook := "#!/bin/sh\necho \"$SUBSYS_SNAPSHOT $SUBSYS_ASSIGNMENT $SUBSYS_STUDENT_ID\" > hook.out\nexit 1\n"
+	os.WriteFile(filepath.Join(utils.HooksPath("."), utils.PreSubmitHook), []byte(hook), 0755)
+
+	err := sm.SubmitSnapshots()
+	if err == nil || !strings.Contains(err.Error(), "pre-submit hook failed") {
+		t.Fatalf("Expected the failing hook to stop the submission, got %v", err)
+	}
+	if requests != 0 {
+		t.Errorf("Expected nothing to be sent to the server, got %d request(s)", requests)
+	}
+
+	output, _ := os.ReadFile("hook.out")
+	if string(output) != "test 12345 9876\n" {
+		t.Errorf("Expected the hook to get the submission's details, got %q", output)
+	}
+}
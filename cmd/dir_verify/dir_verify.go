@@ -0,0 +1,145 @@
+package dirverify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+	"amalitech.org/subsys/utils"
+)
+
+type VerifyManager struct {
+	Target   string
+	Key      string
+	Identity string
+	Output   io.Writer
+}
+
+func NewVerifyManager() *VerifyManager {
+	return &VerifyManager{
+		Identity: utils.DefaultIdentityPath,
+		Output:   os.Stdout,
+	}
+}
+
+func (vm *VerifyManager) VerifySnapshot() error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.StringVar(&vm.Key, "key", "", "Public key the archive must be signed with, your registered key for your own snapshots")
+	flags.StringVar(&vm.Identity, "identity", vm.Identity, "Private key to decrypt an encrypted archive with")
+
+	args, err := utils.ParseInterspersed(flags, os.Args[2:])
+	if err != nil {
+		return err
+	}
+
+	if len(args) != 1 {
+		return errors.New("specify the name of a snapshot or the path of a snapshot archive to verify")
+	}
+	vm.Target = args[0]
+	if dirsnap.HasArchiveExtension(vm.Target) {
+		vm.Target = utils.UserPath(vm.Target)
+	}
+	vm.Identity = utils.UserPath(vm.Identity)
+
+	return vm.Verify()
+}
+
+// Verify checks a snapshot, or an archive downloaded from the server, against
+// the manifest embedded in it. A snapshot must be signed with the registered
+// key, and an archive with the one given by --key, if any.
+func (vm *VerifyManager) Verify() error {
+	data, err := vm.readArchive()
+	if err != nil {
+		return err
+	}
+
+	manifest, err := dirsnap.VerifyArchive(data)
+	if err != nil {
+		return err
+	}
+
+	key := vm.Key
+	if key == "" && !dirsnap.HasArchiveExtension(vm.Target) {
+		config, err := utils.GetConfig()
+		if err == nil {
+			key = config.PublicKey
+		}
+	}
+
+	if key != "" {
+		err = manifest.CheckSigner(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintln(vm.Output, manifest)
+	fmt.Fprintf(vm.Output, "Verified %d file(s), the archive matches its manifest\n", len(manifest.Files))
+	if manifest.Signature != nil {
+		fmt.Fprintf(vm.Output, "Signed with key %s\n", manifest.Signature.Fingerprint())
+	} else {
+		fmt.Fprintln(vm.Output, "The archive isn't signed")
+	}
+	if len(manifest.AllowedSecrets) > 0 {
+		fmt.Fprintf(vm.Output, "The student allowed %d possible secret(s) into the snapshot:\n", len(manifest.AllowedSecrets))
+		for _, finding := range manifest.AllowedSecrets {
+			fmt.Fprintf(vm.Output, "  %s\n", finding)
+		}
+	}
+	fmt.Fprintf(vm.Output, "Archive SHA-256: %x\n", sha256.Sum256(data))
+	return nil
+}
+
+// readArchiveFile reads an archive, decrypting it first if it was encrypted
+// to the lecturer's key.
+func (vm *VerifyManager) readArchiveFile() ([]byte, error) {
+	data, err := os.ReadFile(vm.Target)
+	if err != nil || !utils.IsEncrypted(data) {
+		return data, err
+	}
+
+	key, err := utils.LoadIdentity(vm.Identity)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s is encrypted and there's no private key at %s, give yours with --identity", vm.Target, vm.Identity)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return utils.Decrypt(data, key)
+}
+
+func (vm *VerifyManager) readArchive() ([]byte, error) {
+	if dirsnap.HasArchiveExtension(vm.Target) {
+		if info, err := os.Stat(vm.Target); err == nil && !info.IsDir() {
+			return vm.readArchiveFile()
+		}
+	}
+
+	snapshot, err := dirsnap.LoadSnapshot(vm.Target)
+	if err != nil {
+		if _, statErr := os.Stat(dirsnap.LegacySnapshotPath(vm.Target)); statErr == nil {
+			return nil, fmt.Errorf("snapshot %s was made by an older version of subsys and has no manifest to verify", vm.Target)
+		}
+		return nil, err
+	}
+
+	var archive bytes.Buffer
+	err = snapshot.WriteArchive(&archive)
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshots made before archives were reproducible have no hash recorded
+	hash := fmt.Sprintf("%x", sha256.Sum256(archive.Bytes()))
+	if snapshot.ArchiveSHA256 != "" && hash != snapshot.ArchiveSHA256 {
+		return nil, fmt.Errorf("the archive of snapshot %s is %s, but was %s when it was made", vm.Target, hash, snapshot.ArchiveSHA256)
+	}
+
+	return archive.Bytes(), nil
+}
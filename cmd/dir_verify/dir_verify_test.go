@@ -0,0 +1,261 @@
+package dirverify
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dirinit "amalitech.org/subsys/cmd/dir_init"
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+	"amalitech.org/subsys/utils"
+)
+
+func SetupVerifyTests(t *testing.T) *VerifyManager {
+	tempDir := t.TempDir()
+
+	err := os.Chdir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to change working directory: %v", err)
+	}
+
+	initializer, err := dirinit.NewDirectoryInitializer()
+	if err != nil {
+		t.Fatalf("NewDirectoryInitializer failed: %v", err)
+	}
+
+	err = initializer.Initialize()
+	if err != nil {
+		t.Fatalf("InitializeDirectory failed: %v", err)
+	}
+
+	os.WriteFile("main.py", []byte("print('hello')"), 0644)
+	os.MkdirAll("lib", 0777)
+	os.WriteFile(filepath.Join("lib", "util.py"), []byte("def util(): pass"), 0644)
+
+	os.Args = []string{"program", "snap", "--name", "first"}
+	err = dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	vm := NewVerifyManager()
+	vm.Output = &bytes.Buffer{}
+	return vm
+}
+
+func TestVerifySnapshot(t *testing.T) {
+	vm := SetupVerifyTests(t)
+	vm.Target = "first"
+
+	err := vm.Verify()
+	if err != nil {
+		t.Fatalf("Expected snapshot to verify, got %v", err)
+	}
+
+	output := vm.Output.(*bytes.Buffer).String()
+	if !strings.Contains(output, "Snapshot first of") || !strings.Contains(output, "subsys v"+utils.Version) {
+		t.Errorf("Expected the manifest summary, got %q", output)
+	}
+
+	if !strings.Contains(output, "Verified 2 file(s)") {
+		t.Errorf("Expected 2 verified files, got %q", output)
+	}
+}
+
+func TestVerifyArchiveFile(t *testing.T) {
+	vm := SetupVerifyTests(t)
+
+	snapshot, err := dirsnap.LoadSnapshot("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	err = snapshot.WriteArchive(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile("first.zip", archive.Bytes(), 0644)
+
+	vm.Target = "first.zip"
+	err = vm.Verify()
+	if err != nil {
+		t.Fatalf("Expected archive to verify, got %v", err)
+	}
+
+	// Replace lib/util.py with different contents
+	reader, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tampered bytes.Buffer
+	writer := zip.NewWriter(&tampered)
+	for _, file := range reader.File {
+		entry, _ := writer.Create(file.Name)
+		if file.Name == "lib/util.py" {
+			entry.Write([]byte("def util(): return 1"))
+			continue
+		}
+		rc, _ := file.Open()
+		io.Copy(entry, rc)
+		rc.Close()
+	}
+	writer.Close()
+	os.WriteFile("tampered.zip", tampered.Bytes(), 0644)
+
+	vm.Target = "tampered.zip"
+	err = vm.Verify()
+	if err == nil || !strings.Contains(err.Error(), "altered: lib/util.py") {
+		t.Errorf("Expected verification to report lib/util.py as altered, got %v", err)
+	}
+}
+
+func TestVerifyCorruptedObject(t *testing.T) {
+	vm := SetupVerifyTests(t)
+
+	snapshot, err := dirsnap.LoadSnapshot("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range snapshot.Files {
+		if file.Path == "main.py" {
+			path, _ := utils.ObjectPath(file.Hash)
+			os.WriteFile(path, []byte("not deflate data"), 0644)
+		}
+	}
+
+	vm.Target = "first"
+	err = vm.Verify()
+	if err == nil {
+		t.Errorf("Expected a corrupted object to fail verification")
+	}
+}
+
+func TestVerifyUnknownSnapshot(t *testing.T) {
+	vm := SetupVerifyTests(t)
+	vm.Target = "missing"
+
+	err := vm.Verify()
+	if err == nil || !strings.Contains(err.Error(), "you don't have a snapshot named missing") {
+		t.Errorf("Expected an unknown snapshot error, got %v", err)
+	}
+}
+
+func TestVerifyRecordedHash(t *testing.T) {
+	vm := SetupVerifyTests(t)
+
+	snapshot, err := dirsnap.LoadSnapshot("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm.Target = "first"
+	err = vm.Verify()
+	if err != nil {
+		t.Fatalf("Expected snapshot to verify, got %v", err)
+	}
+
+	if !strings.Contains(vm.Output.(*bytes.Buffer).String(), "Archive SHA-256: "+snapshot.ArchiveSHA256) {
+		t.Errorf("Expected the archive hash to be printed, got %q", vm.Output.(*bytes.Buffer).String())
+	}
+
+	snapshot.ArchiveSHA256 = strings.Repeat("0", 64)
+	err = snapshot.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = vm.Verify()
+	if err == nil || !strings.Contains(err.Error(), "when it was made") {
+		t.Errorf("Expected a changed archive hash to fail verification, got %v", err)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	vm := SetupVerifyTests(t)
+
+	// Unsigned snapshots verify as long as no key is registered
+	vm.Target = "first"
+	err := vm.Verify()
+	if err != nil {
+		t.Fatalf("Expected snapshot to verify, got %v", err)
+	}
+	if !strings.Contains(vm.Output.(*bytes.Buffer).String(), "The archive isn't signed") {
+		t.Errorf("Expected the snapshot to be reported unsigned, got %s", vm.Output.(*bytes.Buffer).String())
+	}
+
+	key, err := utils.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	os.WriteFile("main.py", []byte("print('signed')"), 0644)
+	os.Args = []string{"program", "snap", "--name", "signed"}
+	err = dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	vm.Target = "signed"
+	vm.Key = utils.EncodePublicKey(key)
+	vm.Output = &bytes.Buffer{}
+	err = vm.Verify()
+	if err != nil {
+		t.Fatalf("Expected signed snapshot to verify, got %v", err)
+	}
+	if !strings.Contains(vm.Output.(*bytes.Buffer).String(), "Signed with key "+utils.KeyFingerprint(key)) {
+		t.Errorf("Expected the signer to be reported, got %s", vm.Output.(*bytes.Buffer).String())
+	}
+
+	other, _ := utils.GenerateKey()
+	vm.Key = utils.EncodePublicKey(other)
+	err = vm.Verify()
+	if err == nil || !strings.Contains(err.Error(), "not the expected") {
+		t.Errorf("Expected a snapshot signed with another key to be rejected, got %v", err)
+	}
+
+	vm.Target = "first"
+	err = vm.Verify()
+	if err == nil || !strings.Contains(err.Error(), "isn't signed") {
+		t.Errorf("Expected an unsigned snapshot to be rejected when a key is expected, got %v", err)
+	}
+}
+
+func TestVerifyEncryptedArchive(t *testing.T) {
+	vm := SetupVerifyTests(t)
+
+	snapshot, _ := dirsnap.LoadSnapshot("first")
+	var archive bytes.Buffer
+	snapshot.WriteArchive(&archive)
+
+	vm.Identity = filepath.Join(t.TempDir(), "lecturer.key")
+	public, err := utils.GenerateIdentity(vm.Identity)
+	if err != nil {
+		t.Fatalf("GenerateIdentity failed: %v", err)
+	}
+	recipient, _ := utils.DecodeRecipient(public)
+	sealed, _ := utils.Encrypt(archive.Bytes(), recipient)
+
+	vm.Target = filepath.Join(t.TempDir(), "first.zip.enc")
+	os.WriteFile(vm.Target, sealed, 0644)
+
+	err = vm.Verify()
+	if err != nil {
+		t.Fatalf("Expected the encrypted archive to verify, got %v", err)
+	}
+	if !strings.Contains(vm.Output.(*bytes.Buffer).String(), "Archive SHA-256: "+snapshot.ArchiveSHA256) {
+		t.Errorf("Expected the hash of the decrypted archive, got %s", vm.Output.(*bytes.Buffer).String())
+	}
+
+	vm.Identity = "missing.key"
+	err = vm.Verify()
+	if err == nil || !strings.Contains(err.Error(), "--identity") {
+		t.Errorf("Expected an encrypted archive to need a private key, got %v", err)
+	}
+}
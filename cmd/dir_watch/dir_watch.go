@@ -0,0 +1,226 @@
+package dirwatch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+	"amalitech.org/subsys/utils"
+)
+
+const timeFormat = "15:04:05"
+
+type WatchManager struct {
+	Quiet  time.Duration
+	Every  time.Duration
+	Poll   time.Duration
+	Prefix string
+	Output io.Writer
+
+	// Snap is copied for every automatic snapshot. It's made up front, as
+	// making one can exit on a bad config, which must not happen while the
+	// directory is locked.
+	Snap *dirsnap.SnapshotManager
+}
+
+// watchState is what the watcher remembers between two polls of the tree.
+type watchState struct {
+	fingerprint string
+	changedAt   time.Time
+	snappedAt   time.Time
+
+	// settled is the fingerprint of the tree when it was last snapped, or
+	// found to have nothing new to snap
+	settled string
+}
+
+func NewWatchManager() *WatchManager {
+	return &WatchManager{
+		Quiet:  2 * time.Minute,
+		Every:  15 * time.Minute,
+		Poll:   2 * time.Second,
+		Prefix: "auto",
+		Output: os.Stdout,
+		Snap:   dirsnap.NewSnapshotManager(),
+	}
+}
+
+// Watch snaps the directory automatically until it's interrupted.
+func (wm *WatchManager) Watch() error {
+	err := wm.parseArgs(os.Args[2:])
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	go func() {
+		<-signals
+		close(stop)
+	}()
+
+	fmt.Fprintf(wm.Output, "Watching for changes, press Ctrl+C to stop\n")
+	err = wm.Run(stop)
+	fmt.Fprintf(wm.Output, "Stopped watching\n")
+
+	return err
+}
+
+func (wm *WatchManager) parseArgs(args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	flags.DurationVar(&wm.Quiet, "quiet", wm.Quiet, "Snap once your files have been left alone this long, 0 to never")
+	flags.DurationVar(&wm.Every, "every", wm.Every, "Snap at least this often while you keep working, 0 to never")
+	flags.DurationVar(&wm.Poll, "poll", wm.Poll, "How often to check your files for changes")
+	flags.StringVar(&wm.Prefix, "prefix", wm.Prefix, "Start of the automatic snapshots' names")
+
+	rest, err := utils.ParseInterspersed(flags, args)
+	if err != nil {
+		return err
+	}
+
+	if len(rest) > 0 {
+		return fmt.Errorf("watch takes no arguments, got %v", rest)
+	}
+
+	if wm.Quiet < 0 || wm.Every < 0 {
+		return errors.New("--quiet and --every can't be negative")
+	}
+
+	if wm.Quiet == 0 && wm.Every == 0 {
+		return errors.New("at least one of --quiet and --every must be set")
+	}
+
+	if wm.Poll <= 0 {
+		return errors.New("--poll must be positive")
+	}
+
+	return dirsnap.ValidateSnapshotName(wm.Prefix)
+}
+
+// Run polls the tree until stop is closed. A failed poll is reported but
+// doesn't stop the watch, since the next one may well succeed.
+func (wm *WatchManager) Run(stop <-chan struct{}) error {
+	ticker := time.NewTicker(wm.Poll)
+	defer ticker.Stop()
+
+	state := &watchState{snappedAt: time.Now()}
+	for {
+		select {
+		case <-stop:
+			return nil
+		case now := <-ticker.C:
+			err := wm.tick(state, now)
+			if err != nil {
+				fmt.Fprintf(wm.Output, "[%s] Warning: couldn't take an automatic snapshot: %v\n", now.Format(timeFormat), err)
+			}
+		}
+	}
+}
+
+// tick checks the tree once, and snaps it if it has been quiet for long enough
+// or the last snapshot is due an update.
+func (wm *WatchManager) tick(state *watchState, now time.Time) error {
+	fingerprint, err := treeFingerprint()
+	if err != nil {
+		return err
+	}
+
+	if fingerprint != state.fingerprint {
+		state.fingerprint = fingerprint
+		state.changedAt = now
+	}
+
+	if fingerprint == state.settled {
+		return nil
+	}
+
+	var message string
+	switch {
+	case wm.Quiet > 0 && now.Sub(state.changedAt) >= wm.Quiet:
+		message = fmt.Sprintf("Automatic snapshot after %s without changes", wm.Quiet)
+	case wm.Every > 0 && now.Sub(state.snappedAt) >= wm.Every:
+		message = fmt.Sprintf("Automatic snapshot after %s of work", wm.Every)
+	default:
+		return nil
+	}
+
+	// Another subsys command is changing the directory, try again next time
+	lock, err := utils.LockDirectory(".")
+	if errors.Is(err, utils.ErrLocked) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	sm := *wm.Snap
+	sm.Name = wm.snapshotName(now)
+	sm.Message = message
+
+	err = sm.Snap()
+	if errors.Is(err, dirsnap.ErrNoChanges) {
+		// The files were changed back to how they were snapped
+		state.settled = fingerprint
+		return nil
+	}
+	var secrets *dirsnap.SecretsError
+	var hook *utils.HookError
+	if errors.As(err, &secrets) || errors.As(err, &hook) {
+		// Don't repeat the report, or run the hook, every poll, only once the
+		// files change again
+		state.settled = fingerprint
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	state.settled = fingerprint
+	state.snappedAt = now
+	fmt.Fprintf(wm.Output, "[%s] Took snapshot %s\n", now.Format(timeFormat), sm.Name)
+
+	return nil
+}
+
+// snapshotName names an automatic snapshot after the time it's taken.
+func (wm *WatchManager) snapshotName(now time.Time) string {
+	name := wm.Prefix + "-" + now.Format("20060102-150405")
+	if !dirsnap.SnapshotExists(name) {
+		return name
+	}
+
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s-%d", name, i)
+		if !dirsnap.SnapshotExists(candidate) {
+			return candidate
+		}
+	}
+}
+
+// treeFingerprint hashes the paths, contents and modes of every tracked file,
+// so that any edit to the tree changes it.
+func treeFingerprint() (string, error) {
+	files, err := dirsnap.ScanFiles(".")
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	for _, file := range files {
+		fmt.Fprintf(hash, "%s\x00%s\x00%o\n", file.Path, file.Hash, file.Mode)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
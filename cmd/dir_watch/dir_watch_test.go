@@ -0,0 +1,294 @@
+package dirwatch
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dirinit "amalitech.org/subsys/cmd/dir_init"
+	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+	"amalitech.org/subsys/utils"
+)
+
+func SetupWatchTests(t *testing.T) *WatchManager {
+	tempDir := t.TempDir()
+
+	err := os.Chdir(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to change working directory: %v", err)
+	}
+
+	initializer, err := dirinit.NewDirectoryInitializer()
+	if err != nil {
+		t.Fatalf("NewDirectoryInitializer failed: %v", err)
+	}
+
+	err = initializer.Initialize()
+	if err != nil {
+		t.Fatalf("InitializeDirectory failed: %v", err)
+	}
+
+	os.WriteFile("main.py", []byte("print('hello')"), 0644)
+
+	os.Args = []string{"program", "snap", "--name", "first"}
+	err = dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	wm := NewWatchManager()
+	wm.Output = &bytes.Buffer{}
+	return wm
+}
+
+func snapshotNames(t *testing.T) []string {
+	snapshots, err := dirsnap.ListSnapshots()
+	if err != nil {
+		t.Fatalf("ListSnapshots failed: %v", err)
+	}
+
+	names := make([]string, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		names = append(names, snapshot.Name)
+	}
+	return names
+}
+
+func TestWatchSnapsAfterQuietPeriod(t *testing.T) {
+	wm := SetupWatchTests(t)
+	start := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	state := &watchState{snappedAt: start}
+
+	os.WriteFile("main.py", []byte("print('hello world')"), 0644)
+
+	err := wm.tick(state, start)
+	if err != nil {
+		t.Fatalf("tick failed: %v", err)
+	}
+	if len(snapshotNames(t)) != 1 {
+		t.Fatalf("Expected no snapshot before the quiet period, got %v", snapshotNames(t))
+	}
+
+	err = wm.tick(state, start.Add(wm.Quiet))
+	if err != nil {
+		t.Fatalf("tick failed: %v", err)
+	}
+
+	names := snapshotNames(t)
+	if len(names) != 2 || names[1] != "auto-20240301-100200" {
+		t.Fatalf("Expected an automatic snapshot after the quiet period, got %v", names)
+	}
+
+	snapshot, err := dirsnap.LoadSnapshot(names[1])
+	if err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+	if snapshot.Parent != "first" || !strings.Contains(snapshot.Message, "without changes") {
+		t.Errorf("Unexpected automatic snapshot: %+v", snapshot)
+	}
+
+	if !strings.Contains(wm.Output.(*bytes.Buffer).String(), "Took snapshot auto-20240301-100200") {
+		t.Errorf("Expected the snapshot to be reported, got %q", wm.Output.(*bytes.Buffer).String())
+	}
+}
+
+func TestWatchSnapsWhileWorking(t *testing.T) {
+	wm := SetupWatchTests(t)
+	start := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	state := &watchState{snappedAt: start}
+
+	// Keep editing more often than the quiet period
+	for minute := 0; minute <= 15; minute++ {
+		os.WriteFile("main.py", []byte(strings.Repeat("print('hello')\n", minute+2)), 0644)
+
+		err := wm.tick(state, start.Add(time.Duration(minute)*time.Minute))
+		if err != nil {
+			t.Fatalf("tick failed: %v", err)
+		}
+	}
+
+	names := snapshotNames(t)
+	if len(names) != 2 || names[1] != "auto-20240301-101500" {
+		t.Fatalf("Expected a snapshot after 15 minutes of work, got %v", names)
+	}
+}
+
+func TestWatchSkipsWithoutChanges(t *testing.T) {
+	wm := SetupWatchTests(t)
+	start := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	state := &watchState{snappedAt: start}
+
+	for _, at := range []time.Duration{0, wm.Quiet, wm.Every, 2 * wm.Every} {
+		err := wm.tick(state, start.Add(at))
+		if err != nil {
+			t.Fatalf("tick failed: %v", err)
+		}
+	}
+
+	if len(snapshotNames(t)) != 1 {
+		t.Errorf("Expected no automatic snapshot of an unchanged tree, got %v", snapshotNames(t))
+	}
+
+	// Changing a file and changing it back within the quiet period leaves
+	// nothing to snap either
+	wm.Every = 0
+	os.WriteFile("main.py", []byte("print('bye')"), 0644)
+	wm.tick(state, start.Add(time.Hour))
+	os.WriteFile("main.py", []byte("print('hello')"), 0644)
+	wm.tick(state, start.Add(time.Hour+time.Minute))
+	wm.tick(state, start.Add(2*time.Hour))
+
+	if len(snapshotNames(t)) != 1 {
+		t.Errorf("Expected no automatic snapshot of a reverted tree, got %v", snapshotNames(t))
+	}
+}
+
+func TestSnapshotNameIsUnique(t *testing.T) {
+	wm := SetupWatchTests(t)
+	at := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+
+	os.Args = []string{"program", "snap", "--name", "auto-20240301-100000"}
+	os.WriteFile("main.py", []byte("print('hello world')"), 0644)
+	err := dirsnap.NewSnapshotManager().CreateSnapshot()
+	if err != nil {
+		t.Fatalf("Error creating snapshot: %v", err)
+	}
+
+	name := wm.snapshotName(at)
+	if name != "auto-20240301-100000-2" {
+		t.Errorf("Expected a numbered name, got %s", name)
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	wm := SetupWatchTests(t)
+
+	err := wm.parseArgs([]string{"--quiet", "30s", "--every", "0", "--prefix", "work"})
+	if err != nil {
+		t.Fatalf("parseArgs failed: %v", err)
+	}
+	if wm.Quiet != 30*time.Second || wm.Every != 0 || wm.Prefix != "work" {
+		t.Errorf("Unexpected settings: %+v", wm)
+	}
+
+	invalid := [][]string{
+		{"--quiet", "0", "--every", "0"},
+		{"--every", "-1m"},
+		{"--poll", "0"},
+		{"--prefix", "my work"},
+		{"extra"},
+	}
+	for _, args := range invalid {
+		wm := NewWatchManager()
+		err := wm.parseArgs(args)
+		if err == nil {
+			t.Errorf("Expected %v to be rejected", args)
+		}
+	}
+}
+
+func TestRunStops(t *testing.T) {
+	wm := SetupWatchTests(t)
+	wm.Poll = 10 * time.Millisecond
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- wm.Run(stop)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't stop")
+	}
+}
+
+func TestWatchWaitsForLock(t *testing.T) {
+	wm := SetupWatchTests(t)
+	start := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	state := &watchState{snappedAt: start}
+
+	os.WriteFile("main.py", []byte("print('hello world')"), 0644)
+	wm.tick(state, start)
+
+	lock, err := utils.LockDirectory(".")
+	if err != nil {
+		t.Fatalf("LockDirectory failed: %v", err)
+	}
+
+	err = wm.tick(state, start.Add(wm.Quiet))
+	if err != nil {
+		t.Fatalf("tick failed: %v", err)
+	}
+	if len(snapshotNames(t)) != 1 {
+		t.Fatalf("Expected no snapshot while another command holds the lock, got %v", snapshotNames(t))
+	}
+
+	lock.Unlock()
+	err = wm.tick(state, start.Add(wm.Quiet+time.Second))
+	if err != nil {
+		t.Fatalf("tick failed: %v", err)
+	}
+	if len(snapshotNames(t)) != 2 {
+		t.Fatalf("Expected a snapshot once the lock was released, got %v", snapshotNames(t))
+	}
+	if _, err := os.Stat(utils.LockPath(".")); !os.IsNotExist(err) {
+		t.Errorf("Expected the lock to be released after snapping")
+	}
+}
+
+func TestWatchRunsHooks(t *testing.T) {
+	wm := SetupWatchTests(t)
+	start := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	state := &watchState{snappedAt: start}
+
+	os.MkdirAll(utils.HooksPath("."), 0777)
+	os.WriteFile(filepath.Join(utils.HooksPath("."), utils.PreSnapHook), []byte("#!/bin/sh\necho run >> ../pre-snap.out\ntest ! -e blocked\n"), 0755)
+	os.WriteFile(filepath.Join(utils.HooksPath("."), utils.PostSnapHook), []byte("#!/bin/sh\necho \"$SUBSYS_SNAPSHOT\" > ../post-snap.out\n"), 0755)
+
+	os.WriteFile("main.py", []byte("print('hello world')"), 0644)
+	wm.tick(state, start)
+	err := wm.tick(state, start.Add(wm.Quiet))
+	if err != nil {
+		t.Fatalf("tick failed: %v", err)
+	}
+
+	output, _ := os.ReadFile(filepath.Join("..", "post-snap.out"))
+	if string(output) != "auto-20240301-100200\n" {
+		t.Errorf("Expected the post-snap hook to run for the automatic snapshot, got %q", output)
+	}
+
+	// A failing pre-snap hook stops the snapshot, and isn't run again until
+	// the files change
+	os.WriteFile("blocked", []byte(""), 0644)
+	wm.tick(state, start.Add(wm.Quiet+time.Minute))
+	err = wm.tick(state, start.Add(2*wm.Quiet+time.Minute))
+	var hook *utils.HookError
+	if !errors.As(err, &hook) {
+		t.Fatalf("Expected the pre-snap hook to fail, got %v", err)
+	}
+	if len(snapshotNames(t)) != 2 {
+		t.Errorf("Expected no snapshot while the pre-snap hook fails, got %v", snapshotNames(t))
+	}
+
+	err = wm.tick(state, start.Add(3*wm.Quiet+time.Minute))
+	if err != nil {
+		t.Fatalf("Expected the failure to be reported once, got %v", err)
+	}
+
+	output, _ = os.ReadFile(filepath.Join("..", "pre-snap.out"))
+	if runs := strings.Count(string(output), "run"); runs != 2 {
+		t.Errorf("Expected the pre-snap hook to run twice, ran %d times", runs)
+	}
+}
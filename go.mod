@@ -1,3 +1,8 @@
 module amalitech.org/subsys
 
 go 1.21
+
+require (
+	github.com/klauspost/compress v1.17.11
+	golang.org/x/crypto v0.33.0
+)
@@ -1,16 +1,27 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strings"
 
+	dirbundle "amalitech.org/subsys/cmd/dir_bundle"
 	dirclone "amalitech.org/subsys/cmd/dir_clone"
 	dirconfig "amalitech.org/subsys/cmd/dir_config"
+	dirdiff "amalitech.org/subsys/cmd/dir_diff"
 	dirinit "amalitech.org/subsys/cmd/dir_init"
+	dirkeys "amalitech.org/subsys/cmd/dir_keys"
+	dirlog "amalitech.org/subsys/cmd/dir_log"
+	dirrestore "amalitech.org/subsys/cmd/dir_restore"
 	dirsnap "amalitech.org/subsys/cmd/dir_snap"
+	dirsnapshots "amalitech.org/subsys/cmd/dir_snapshots"
+	dirstatus "amalitech.org/subsys/cmd/dir_status"
 	dirsubmission "amalitech.org/subsys/cmd/dir_submission"
+	dirverify "amalitech.org/subsys/cmd/dir_verify"
+	dirwatch "amalitech.org/subsys/cmd/dir_watch"
+	"amalitech.org/subsys/utils"
 )
 
 type Command int
@@ -21,8 +32,19 @@ const (
 	Snap
 	Submit
 	Clone
+	Log
+	Diff
+	Restore
+	Status
+	Verify
+	Snapshots
+	Watch
+	Bundle
+	Keys
 )
 
+var commands = []Command{Init, Config, Snap, Submit, Clone, Log, Diff, Restore, Status, Verify, Snapshots, Watch, Bundle, Keys}
+
 func (c Command) String() string {
 	switch c {
 	case Init:
@@ -35,26 +57,55 @@ func (c Command) String() string {
 		return "submit"
 	case Clone:
 		return "clone"
+	case Log:
+		return "log"
+	case Diff:
+		return "diff"
+	case Restore:
+		return "restore"
+	case Status:
+		return "status"
+	case Verify:
+		return "verify"
+	case Snapshots:
+		return "snapshots"
+	case Watch:
+		return "watch"
+	case Bundle:
+		return "bundle"
+	case Keys:
+		return "keys"
 	default:
 		return "unknown"
 	}
 }
 
+// changesDirectory reports whether a command writes to the subsys directory,
+// and so has to hold its lock. Watch only takes it while it snaps.
+func (c Command) changesDirectory() bool {
+	switch c {
+	case Config, Snap, Submit, Restore, Snapshots, Bundle, Keys:
+		return true
+	default:
+		return false
+	}
+}
+
 func Greet() string {
-	return "Welcome to subsys v0.0.1, an assignment submission platform\nCommands:\nsubsys init - This command is for initialising a new subsys directory\n\nsubsys config - This command is for configuring your directory\nFlags: --code 'Your assignmnent code' --student_id 'Your student ID'\n\nsubsys snap - This command is for making a snapshot of your work, it's what is going to be submitted\nFlags: --name 'Name of the snapshot to create'\n\nsubsys submit - This command allows you to specify a snapshot to submit or submit all snapshots if you don't specify a snapshot\nFlags: --name 'Name of the snapshot to submit'\n\nsubsys clone - This command allows a lecture to download student's snapshots and run them locally"
+	return "Welcome to subsys v" + utils.Version + ", an assignment submission platform\nCommands can be run from anywhere inside a subsys directory. Flags: --root 'Run in this subsys directory instead', before the command, or set SUBSYS_DIR\nHooks: executable pre-snap, post-snap, pre-submit and post-clone scripts in .subsys/hooks run at those points, and one that fails stops the command\nCommands:\nsubsys init - This command is for initialising a new subsys directory\nFlags: --preset 'go, python, node, java or c, to ignore their build outputs and dependencies' --honor-gitignore 'Also apply your .gitignore files'\n\nsubsys config - This command is for configuring your directory\nFlags: --code 'Your assignmnent code' --student_id 'Your student ID' --format 'Archive format your snapshots are submitted in: zip, tar.gz or tar.zst' --lecturer-key 'Your lecturer's public key, to encrypt your submissions to'\n\nsubsys snap - This command is for making a snapshot of your work, it's what is going to be submitted\nFlags: --name 'Name of the snapshot to create' --message 'Describe what changed' --force 'Replace an existing snapshot with the same name' --format 'zip, tar.gz or tar.zst, the configured format by default' --dry-run 'List the files that would be snapped and the archive's estimated size' --include 'Only snap files matching these patterns' --exclude 'Leave out files matching these patterns'\n\nsubsys submit - This command allows you to specify a snapshot to submit or submit all snapshots if you don't specify a snapshot\nFlags: --name 'Name of the snapshot to submit'\n\nsubsys clone - This command allows a lecture to download student's snapshots and run them locally\nFlags: --identity 'Private key to decrypt encrypted submissions with, lecturer.key by default' --key 'Public key registered for the student, the snapshot must be signed with it'\n\nsubsys log - This command shows the history of your snapshots\nFlags: --json 'Print the history as JSON'\n\nsubsys diff [snapshot] [snapshot] - This command shows line changes between two snapshots, or between a snapshot (the latest by default) and your current files\nFlags: --stat 'Show a summary of changed files' --name-only 'Show only the names of changed files'\n\nsubsys restore [path...] - This command brings your files, or only the paths you list, back to how they were in a snapshot\nFlags: --name 'Name of the snapshot to restore' --force 'Overwrite changes that haven't been snapped'\n\nsubsys status - This command shows the changes you haven't snapped yet and whether your latest snapshot was submitted\n\nsubsys verify <snapshot or archive> - This command checks that a snapshot, or a downloaded archive, contains exactly the files recorded in its manifest and that its signature is valid\nFlags: --key 'Public key the archive must be signed with' --identity 'Private key to decrypt an encrypted archive with'\n\nsubsys snapshots list|show|rename|rm|prune - This command lists your snapshots, shows one in detail, renames or removes them, or prunes old ones\nFlags: --keep 'Number of recent snapshots prune keeps, submitted ones are always kept' --dry-run 'Show what prune would remove'\n\nsubsys watch - This command keeps running while you work and snaps your files automatically, naming the snapshots after the time they're taken\nFlags: --quiet 'Snap after your files are left alone this long, 2m by default' --every 'Snap at least this often while you keep working, 15m by default' --poll 'How often to check for changes' --prefix 'Start of the snapshots' names, auto by default'\n\nsubsys bundle export [snapshot...] | import <bundle> - This command packs snapshots and their history into a single file to hand in offline, for example on a USB stick, and loads such a file back\nFlags: --output 'File to export to' --into 'Inbox directory to import into, sorted by assignment and student' --force 'Replace snapshots that already exist'\n\nsubsys keys generate|show|lecturer - This command creates the key your snapshots are signed with and registers it with your student ID, shows the registered key, or creates a lecturer's key for receiving encrypted submissions\nFlags: --force 'Replace your existing key' --output 'File to write the lecturer's private key to'"
 }
 
 func allowedCommands() string {
-	var commands []string
-	for _, command := range []Command{Init, Config, Snap, Submit, Clone} {
-		commands = append(commands, command.String())
+	var names []string
+	for _, command := range commands {
+		names = append(names, command.String())
 	}
 
-	return strings.Join(commands, ", ")
+	return strings.Join(names, ", ")
 }
 
 func CommandFromString(commandStr string) (Command, error) {
-	for _, command := range []Command{Init, Config, Snap, Submit, Clone} {
+	for _, command := range commands {
 		if command.String() == commandStr {
 			return command, nil
 		}
@@ -63,7 +114,37 @@ func CommandFromString(commandStr string) (Command, error) {
 	return Command(0), fmt.Errorf("unknown command: %s", commandStr)
 }
 
+// globalFlags removes the flags given before the command, such as
+// subsys --root ../project snap, from args and returns the root.
+func globalFlags(args []string) ([]string, string, error) {
+	root := ""
+	for len(args) > 1 && strings.HasPrefix(args[1], "-") {
+		flag := strings.TrimLeft(args[1], "-")
+		switch {
+		case flag == "root":
+			if len(args) < 3 {
+				return nil, "", errors.New("--root needs a directory")
+			}
+			root = args[2]
+			args = append(args[:1:1], args[3:]...)
+		case strings.HasPrefix(flag, "root="):
+			root = strings.TrimPrefix(flag, "root=")
+			args = append(args[:1:1], args[2:]...)
+		default:
+			return nil, "", fmt.Errorf("unknown flag %s, give the command's flags after it", args[1])
+		}
+	}
+
+	return args, root, nil
+}
+
 func main() {
+	args, root, err := globalFlags(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Args = args
+
 	var command Command
 	if len(os.Args) > 1 {
 		cmd, err := CommandFromString(os.Args[1])
@@ -77,16 +158,52 @@ func main() {
 		return
 	}
 
+	// A new directory is made where subsys init is run, unless told otherwise,
+	// and clones are downloaded there
+	if (command != Init || root != "" || os.Getenv(utils.RootEnv) != "") && command != Clone {
+		err := utils.EnterRoot(root)
+		if err != nil {
+			log.Fatalf("Error finding the subsys directory: %v\n", err)
+		}
+	}
+
+	var lock *utils.Lock
+	if _, err := os.Stat(".subsys"); err == nil && command.changesDirectory() {
+		lock, err = utils.LockDirectory(".")
+		if err != nil {
+			log.Fatalf("Error locking the subsys directory: %v\n", err)
+		}
+	}
+
+	err = run(command)
+
+	// log.Fatal exits without running deferred calls, so the lock is
+	// released first
+	if lock != nil {
+		lock.Unlock()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run runs a command, returning its error for main to report.
+func run(command Command) error {
 	switch command {
 	case Init:
 		initializer, err := dirinit.NewDirectoryInitializer()
 		if err != nil {
-			log.Fatalf("Error creating SubmissionInitializer: %v", err)
+			return fmt.Errorf("Error creating SubmissionInitializer: %v", err)
+		}
+
+		err = initializer.ParseFlags(os.Args[2:])
+		if err != nil {
+			return fmt.Errorf("Error initializing submission: %v", err)
 		}
 
 		err = initializer.Initialize()
 		if err != nil {
-			log.Fatalf("Error initializing submission: %v", err)
+			return fmt.Errorf("Error initializing submission: %v", err)
 		}
 
 	case Config:
@@ -94,7 +211,7 @@ func main() {
 
 		err := configurator.ConfigureDirectory()
 		if err != nil {
-			log.Fatalf("Error configuring directory: %v\n", err)
+			return fmt.Errorf("Error configuring directory: %v", err)
 		}
 
 	case Snap:
@@ -102,7 +219,7 @@ func main() {
 
 		err := snapshotManager.CreateSnapshot()
 		if err != nil {
-			log.Fatalf("Error making a new snaphot: %v\n", err)
+			return fmt.Errorf("Error making a new snaphot: %v", err)
 		}
 
 	case Submit:
@@ -110,15 +227,88 @@ func main() {
 
 		err := submissionManager.SubmitSnapshots()
 		if err != nil {
-			log.Fatalf("Error submitting snapshot: %v\n", err)
+			return fmt.Errorf("Error submitting snapshot: %v", err)
 		}
 	case Clone:
 		cloneManager := dirclone.NewCloneManager()
 
 		err := cloneManager.CloneSnapshot()
 		if err != nil {
-			log.Fatalf("Error cloning submission: %v\n", err)
+			return fmt.Errorf("Error cloning submission: %v", err)
+		}
+
+	case Log:
+		logManager := dirlog.NewLogManager()
+
+		err := logManager.ShowLog()
+		if err != nil {
+			return fmt.Errorf("Error showing snapshot history: %v", err)
+		}
+
+	case Diff:
+		diffManager := dirdiff.NewDiffManager()
+
+		err := diffManager.ShowDiff()
+		if err != nil {
+			return fmt.Errorf("Error showing diff: %v", err)
+		}
+
+	case Restore:
+		restoreManager := dirrestore.NewRestoreManager()
+
+		err := restoreManager.RestoreSnapshot()
+		if err != nil {
+			return fmt.Errorf("Error restoring snapshot: %v", err)
+		}
+
+	case Status:
+		statusManager := dirstatus.NewStatusManager()
+
+		err := statusManager.ShowStatus()
+		if err != nil {
+			return fmt.Errorf("Error showing status: %v", err)
+		}
+
+	case Verify:
+		verifyManager := dirverify.NewVerifyManager()
+
+		err := verifyManager.VerifySnapshot()
+		if err != nil {
+			return fmt.Errorf("Error verifying snapshot: %v", err)
+		}
+
+	case Snapshots:
+		snapshotsManager := dirsnapshots.NewSnapshotsManager()
+
+		err := snapshotsManager.ManageSnapshots()
+		if err != nil {
+			return fmt.Errorf("Error managing snapshots: %v", err)
+		}
+
+	case Watch:
+		watchManager := dirwatch.NewWatchManager()
+
+		err := watchManager.Watch()
+		if err != nil {
+			return fmt.Errorf("Error watching directory: %v", err)
+		}
+
+	case Bundle:
+		bundleManager := dirbundle.NewBundleManager()
+
+		err := bundleManager.ManageBundles()
+		if err != nil {
+			return fmt.Errorf("Error managing bundles: %v", err)
+		}
+
+	case Keys:
+		keysManager := dirkeys.NewKeysManager()
+
+		err := keysManager.ManageKeys()
+		if err != nil {
+			return fmt.Errorf("Error managing keys: %v", err)
 		}
 	}
 
+	return nil
 }
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic replaces a file so that it's either entirely the old or
+// entirely the new contents, even if subsys is stopped or the machine loses
+// power halfway. The data is written to a temporary file beside it, flushed
+// to disk and renamed over the file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		return err
+	}
+
+	err = tmp.Chmod(perm)
+	if err != nil {
+		return err
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// syncDir flushes a rename to disk. Not every system can open a directory to
+// sync it, and the rename has happened either way, so failures are ignored.
+func syncDir(dir string) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	file.Sync()
+}
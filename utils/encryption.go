@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted archives start with encryptionMagic, then the sender's one-off
+// X25519 public key and the AES-GCM nonce. The AES-256 key is derived with
+// HKDF-SHA256 from the X25519 shared secret, so only the holder of the
+// recipient's private key can decrypt them.
+var encryptionMagic = []byte("subsys-encrypted-v1\n")
+
+const encryptionInfo = "subsys archive encryption v1"
+
+// EncryptedExtension is added to the name of an encrypted archive.
+const EncryptedExtension = ".enc"
+
+// DefaultIdentityPath is where a lecturer's private key is looked for when no
+// other one is given.
+const DefaultIdentityPath = "lecturer.key"
+
+var ErrNotEncrypted = errors.New("the archive isn't encrypted")
+
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptionMagic)
+}
+
+// GenerateIdentity creates an X25519 key pair for receiving encrypted
+// archives. The private key is written to path and the encoded public key,
+// to share with students, is returned.
+func GenerateIdentity(path string) (string, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = file.Write(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+func LoadIdentity(path string) (*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s isn't a PEM encoded key", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	private, ok := key.(*ecdh.PrivateKey)
+	if !ok || private.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("%s isn't an X25519 key", path)
+	}
+
+	return private, nil
+}
+
+func DecodeRecipient(encoded string) (*ecdh.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("%q isn't an X25519 public key", encoded)
+	}
+
+	key, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%q isn't an X25519 public key", encoded)
+	}
+
+	return key, nil
+}
+
+// Encrypt seals data so that only recipient's private key can open it.
+func Encrypt(data []byte, recipient *ecdh.PublicKey) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append(append([]byte{}, encryptionMagic...), ephemeral.PublicKey().Bytes()...)
+	aead, err := newArchiveCipher(shared, ephemeral.PublicKey().Bytes(), recipient.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := append(header, nonce...)
+	return aead.Seal(sealed, nonce, data, header), nil
+}
+
+// Decrypt opens data encrypted with Encrypt to key's public half.
+func Decrypt(data []byte, key *ecdh.PrivateKey) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return nil, ErrNotEncrypted
+	}
+
+	headerSize := len(encryptionMagic) + 32
+	if len(data) < headerSize+12 {
+		return nil, errors.New("the encrypted archive is truncated")
+	}
+
+	header := data[:headerSize]
+	ephemeral, err := ecdh.X25519().NewPublicKey(header[len(encryptionMagic):])
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newArchiveCipher(shared, ephemeral.Bytes(), key.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := data[headerSize : headerSize+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, data[headerSize+aead.NonceSize():], header)
+	if err != nil {
+		return nil, errors.New("couldn't decrypt the archive, it was encrypted to a different key or has been altered")
+	}
+
+	return plain, nil
+}
+
+// newArchiveCipher derives the AES-256-GCM key with HKDF-SHA256, salted with
+// both public keys.
+func newArchiveCipher(shared []byte, ephemeral []byte, recipient []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(encryptionInfo)), key)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,22 @@
+package utils
+
+import "flag"
+
+// ParseInterspersed parses flags that may appear before, between or after
+// positional arguments, and returns the positional arguments in order.
+func ParseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
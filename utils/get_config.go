@@ -8,7 +8,11 @@ import (
 )
 
 func GetConfig() (AssignmentConfig, error) {
-	file, err := os.ReadFile(filepath.Join(".subsys", "config.json"))
+	return readConfig(".")
+}
+
+func readConfig(root string) (AssignmentConfig, error) {
+	file, err := os.ReadFile(filepath.Join(root, ".subsys", "config.json"))
 	if err != nil {
 		err = errors.New("this is not a subsys directory")
 		return AssignmentConfig{}, err
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Hooks are executable files in .subsys/hooks named after the point they run
+// at, like git's. The .subsys directory is never part of a snapshot, so hooks
+// only come from whoever set up the directory, never from a submission.
+const (
+	PreSnapHook   = "pre-snap"
+	PostSnapHook  = "post-snap"
+	PreSubmitHook = "pre-submit"
+	PostCloneHook = "post-clone"
+)
+
+func HooksPath(root string) string {
+	return filepath.Join(root, ".subsys", "hooks")
+}
+
+// RunHook runs the hook called name from the subsys directory root, if there
+// is one, in the directory dir. The hook gets env as SUBSYS_ variables along
+// with the assignment's config, and an error is returned if it exits non-zero
+// so the operation can be stopped.
+func RunHook(root string, name string, dir string, env map[string]string) error {
+	path, err := filepath.Abs(filepath.Join(HooksPath(root), name))
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() || info.Mode().Perm()&0111 == 0 {
+		fmt.Printf("Warning: the %s hook was ignored because it isn't executable, make it so with chmod +x %s\n", name, path)
+		return nil
+	}
+
+	absoluteRoot, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+
+	variables := map[string]string{
+		"SUBSYS_HOOK": name,
+		"SUBSYS_ROOT": absoluteRoot,
+	}
+
+	config, err := readConfig(root)
+	if err == nil {
+		variables["SUBSYS_PROJECT"] = config.ProjectName
+		variables["SUBSYS_ASSIGNMENT"] = config.AssignmentCode
+		variables["SUBSYS_STUDENT_ID"] = config.StudentID
+	}
+
+	for key, value := range env {
+		variables["SUBSYS_"+key] = value
+	}
+
+	names := make([]string, 0, len(variables))
+	for key := range variables {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	environment := make([]string, 0, len(names))
+	for _, key := range names {
+		environment = append(environment, key+"="+variables[key])
+	}
+
+	fmt.Printf("Running the %s hook\n", name)
+	err = RunCommand(dir, environment, path)
+	if err != nil {
+		return &HookError{Hook: name, Err: err}
+	}
+
+	return nil
+}
+
+// HookError is returned when a hook exits non-zero.
+type HookError struct {
+	Hook string
+	Err  error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("the %s hook failed: %v", e.Hook, e.Err)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
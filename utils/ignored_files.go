@@ -2,27 +2,227 @@ package utils
 
 import (
 	"fmt"
-	"io/ioutil"
+	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
-func GetIgnoredFiles(dir string) ([]string, error) {
-	ignoredFiles, err := ioutil.ReadFile(filepath.Join(dir))
+type ignorePattern struct {
+	regex   *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	base    string
+}
+
+// IgnoreMatcher applies subsysignore patterns with the same rules as gitignore.
+// Every directory may hold its own subsysignore, whose patterns are relative
+// to that directory and take precedence over the ones above it.
+type IgnoreMatcher struct {
+	root           string
+	honorGitignore bool
+	loaded         map[string]bool
+	patterns       []ignorePattern
+}
+
+// LoadIgnoreMatcher prepares a matcher for the tree at root. The .subsys
+// directory is always ignored, and .gitignore files are read as well when the
+// directory was initialised with --honor-gitignore.
+func LoadIgnoreMatcher(root string) (*IgnoreMatcher, error) {
+	config, _ := readConfig(root)
+
+	matcher := &IgnoreMatcher{
+		root:           root,
+		honorGitignore: config.HonorGitignore,
+		loaded:         map[string]bool{},
+	}
+	matcher.AddPatterns("", []string{"/.subsys/"})
+
+	err := matcher.loadDirectory("")
 	if err != nil {
-		fmt.Printf("Error reading subsysignore file: %v", err)
-		return []string{}, err
+		return nil, err
 	}
 
-	lines := strings.Split(string(ignoredFiles), "\n")
-	return lines, nil
+	return matcher, nil
+}
+
+func NewIgnoreMatcher(lines []string) *IgnoreMatcher {
+	matcher := &IgnoreMatcher{loaded: map[string]bool{"": true}}
+	matcher.AddPatterns("", lines)
+	return matcher
+}
+
+// AddPatterns adds patterns relative to base, a slash separated directory.
+func (m *IgnoreMatcher) AddPatterns(base string, lines []string) {
+	for _, line := range lines {
+		pattern, ok := parseIgnorePattern(line)
+		if ok {
+			pattern.base = base
+			m.patterns = append(m.patterns, pattern)
+		}
+	}
 }
 
-func Contains(arr []string, str string) bool {
-	for _, item := range arr {
-		if strings.Contains(str, item) {
+func (m *IgnoreMatcher) loadDirectory(dir string) error {
+	if m.loaded[dir] || m.root == "" {
+		return nil
+	}
+	m.loaded[dir] = true
+
+	files := []string{"subsysignore"}
+	if m.honorGitignore {
+		files = []string{".gitignore", "subsysignore"}
+	}
+
+	for _, name := range files {
+		data, err := os.ReadFile(filepath.Join(m.root, filepath.FromSlash(dir), name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("error reading %s: %v", path.Join(dir, name), err)
+		}
+
+		m.AddPatterns(dir, strings.Split(string(data), "\n"))
+	}
+
+	return nil
+}
+
+// Ignored reports whether a slash separated path, relative to the root, is
+// ignored. As in git, a file inside an ignored directory can't be re-included
+// by a negated pattern.
+func (m *IgnoreMatcher) Ignored(name string, isDir bool) bool {
+	name = strings.TrimPrefix(path.Clean(filepath.ToSlash(name)), "./")
+	if name == "." || name == "" {
+		return false
+	}
+
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		dir := strings.Join(parts[:i], "/")
+		if m.match(dir, true) {
 			return true
 		}
+
+		err := m.loadDirectory(dir)
+		if err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+
+	return m.match(name, isDir)
+}
+
+// match applies the patterns to a single path, the last matching one wins.
+func (m *IgnoreMatcher) match(name string, isDir bool) bool {
+	ignored := false
+	for _, pattern := range m.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+
+		relative := name
+		if pattern.base != "" {
+			if !strings.HasPrefix(name, pattern.base+"/") {
+				continue
+			}
+			relative = strings.TrimPrefix(name, pattern.base+"/")
+		}
+
+		if pattern.regex.MatchString(relative) {
+			ignored = !pattern.negate
+		}
+	}
+	return ignored
+}
+
+func parseIgnorePattern(line string) (ignorePattern, bool) {
+	line = strings.TrimSuffix(line, "\r")
+
+	// Trailing spaces are dropped unless escaped with a backslash
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = strings.TrimSuffix(line, " ")
+	}
+
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignorePattern{}, false
+	}
+
+	pattern := ignorePattern{}
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
 	}
-	return false
+
+	if line == "" {
+		return ignorePattern{}, false
+	}
+
+	// A slash anywhere but at the end anchors the pattern to the ignore file's directory
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expression := globToRegex(line)
+	if anchored {
+		expression = "^" + expression + "$"
+	} else {
+		expression = "^(?:.*/)?" + expression + "$"
+	}
+
+	regex, err := regexp.Compile(expression)
+	if err != nil {
+		return ignorePattern{}, false
+	}
+	pattern.regex = regex
+
+	return pattern, true
+}
+
+func globToRegex(glob string) string {
+	var expression strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/'):
+			expression.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**") && i+2 == len(glob) && (i == 0 || glob[i-1] == '/'):
+			expression.WriteString(".*")
+			i++
+		case c == '*':
+			expression.WriteString("[^/]*")
+		case c == '?':
+			expression.WriteString("[^/]")
+		case c == '\\' && i+1 < len(glob):
+			i++
+			expression.WriteString(regexp.QuoteMeta(string(glob[i])))
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expression.WriteString("\\[")
+				continue
+			}
+
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expression.WriteString("[" + strings.ReplaceAll(class, "\\", "\\\\") + "]")
+			i += end + 1
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return expression.String()
 }
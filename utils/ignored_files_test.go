@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadIgnoreMatcherReadsRootConfig(t *testing.T) {
+	// The matcher is loaded for a directory other than the working one
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, ".subsys"), 0777)
+	os.WriteFile(filepath.Join(root, ".subsys", "config.json"), []byte(`{"HonorGitignore": true}`), 0644)
+	os.WriteFile(filepath.Join(root, ".gitignore"), []byte("*.log\n"), 0644)
+	os.WriteFile(filepath.Join(root, "subsysignore"), []byte("build/\n"), 0644)
+
+	matcher, err := LoadIgnoreMatcher(root)
+	if err != nil {
+		t.Fatalf("LoadIgnoreMatcher failed: %v", err)
+	}
+
+	for name, expected := range map[string]bool{
+		"debug.log":      true,
+		"build":          true,
+		".subsys":        true,
+		"main.py":        false,
+		"src/server.log": true,
+	} {
+		if ignored := matcher.Ignored(name, name == "build" || name == ".subsys"); ignored != expected {
+			t.Errorf("Ignored(%q) = %v, expected %v", name, ignored, expected)
+		}
+	}
+}
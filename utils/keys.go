@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoKey is returned when this directory has no signing key yet.
+var ErrNoKey = errors.New("you have no signing key, create one with the subsys keys generate command")
+
+func PrivateKeyPath() string {
+	return filepath.Join(".subsys", "keys", "id_ed25519")
+}
+
+func PublicKeyPath() string {
+	return PrivateKeyPath() + ".pub"
+}
+
+// GenerateKey creates an Ed25519 key pair, keeping the private key readable
+// only by its owner.
+func GenerateKey() (ed25519.PublicKey, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(PrivateKeyPath()), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	err = WriteFileAtomic(PrivateKeyPath(), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return public, WriteFileAtomic(PublicKeyPath(), []byte(EncodePublicKey(public)+"\n"), 0644)
+}
+
+// LoadPrivateKey reads the signing key, returning ErrNoKey if there is none.
+func LoadPrivateKey() (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(PrivateKeyPath())
+	if os.IsNotExist(err) {
+		return nil, ErrNoKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s isn't a PEM encoded key", PrivateKeyPath())
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't an Ed25519 key", PrivateKeyPath())
+	}
+
+	return private, nil
+}
+
+func EncodePublicKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func DecodePublicKey(encoded string) (ed25519.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%q isn't an Ed25519 public key", encoded)
+	}
+
+	return ed25519.PublicKey(data), nil
+}
+
+// KeyFingerprint is a short form of a public key to compare by eye, in the
+// same style as ssh-keygen -l.
+func KeyFingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,287 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+type DiffOp int
+
+const (
+	DiffEqual DiffOp = iota
+	DiffInsert
+	DiffDelete
+)
+
+type DiffLine struct {
+	Op   DiffOp
+	Text string
+}
+
+// maxDiffEdits bounds the work done by DiffLines. Past it the remaining lines
+// are reported as replaced, which is correct but not minimal.
+const maxDiffEdits = 2000
+
+// IsBinary uses the same heuristic as git: a NUL byte near the start of the file.
+func IsBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) != -1
+}
+
+// SplitLines splits text into lines, keeping the line terminators so that a
+// missing newline at the end of a file shows up as a change.
+func SplitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// DiffLines computes a shortest edit script between a and b using Myers' algorithm.
+func DiffLines(a, b []string) []DiffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	result := make([]DiffLine, 0, len(a)+len(b))
+	for _, line := range a[:prefix] {
+		result = append(result, DiffLine{Op: DiffEqual, Text: line})
+	}
+
+	result = append(result, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+
+	for _, line := range a[len(a)-suffix:] {
+		result = append(result, DiffLine{Op: DiffEqual, Text: line})
+	}
+
+	return result
+}
+
+func myers(a, b []string) []DiffLine {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil
+	}
+
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	trace := make([][]int, 0)
+
+	for d := 0; d <= max; d++ {
+		if d > maxDiffEdits {
+			return replaceAll(a, b)
+		}
+
+		// Only diagonals -d-1..d+1 can be read when backtracking through round d
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				return backtrack(a, b, trace)
+			}
+		}
+	}
+
+	return replaceAll(a, b)
+}
+
+func backtrack(a, b []string, trace [][]int) []DiffLine {
+	reversed := make([]DiffLine, 0, len(a)+len(b))
+	x, y := len(a), len(b)
+
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		offset := d + 1
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			reversed = append(reversed, DiffLine{Op: DiffEqual, Text: a[x-1]})
+			x--
+			y--
+		}
+
+		if d > 0 {
+			if x == prevX {
+				reversed = append(reversed, DiffLine{Op: DiffInsert, Text: b[y-1]})
+			} else {
+				reversed = append(reversed, DiffLine{Op: DiffDelete, Text: a[x-1]})
+			}
+		}
+
+		x, y = prevX, prevY
+	}
+
+	result := make([]DiffLine, len(reversed))
+	for i, line := range reversed {
+		result[len(reversed)-1-i] = line
+	}
+
+	return result
+}
+
+func replaceAll(a, b []string) []DiffLine {
+	result := make([]DiffLine, 0, len(a)+len(b))
+	for _, line := range a {
+		result = append(result, DiffLine{Op: DiffDelete, Text: line})
+	}
+	for _, line := range b {
+		result = append(result, DiffLine{Op: DiffInsert, Text: line})
+	}
+	return result
+}
+
+// Similarity estimates how much of two files is the same, as a percentage of
+// the larger one, from the bytes of the lines they have in common.
+func Similarity(a, b []byte) int {
+	larger := max(len(a), len(b))
+	if larger == 0 {
+		return 100
+	}
+
+	counts := map[string]int{}
+	for _, line := range SplitLines(string(a)) {
+		counts[line]++
+	}
+
+	common := 0
+	for _, line := range SplitLines(string(b)) {
+		if counts[line] > 0 {
+			counts[line]--
+			common += len(line)
+		}
+	}
+
+	return common * 100 / larger
+}
+
+// DiffStat counts the inserted and deleted lines in a diff.
+func DiffStat(lines []DiffLine) (insertions int, deletions int) {
+	for _, line := range lines {
+		switch line.Op {
+		case DiffInsert:
+			insertions++
+		case DiffDelete:
+			deletions++
+		}
+	}
+	return insertions, deletions
+}
+
+// UnifiedHunks renders a diff as unified diff hunks with the given number of context lines.
+func UnifiedHunks(lines []DiffLine, context int) string {
+	var out strings.Builder
+
+	oldLine := make([]int, len(lines)+1)
+	newLine := make([]int, len(lines)+1)
+	for i, line := range lines {
+		oldLine[i+1] = oldLine[i]
+		newLine[i+1] = newLine[i]
+		if line.Op != DiffInsert {
+			oldLine[i+1]++
+		}
+		if line.Op != DiffDelete {
+			newLine[i+1]++
+		}
+	}
+
+	i := 0
+	for i < len(lines) {
+		if lines[i].Op == DiffEqual {
+			i++
+			continue
+		}
+
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+
+		end := i
+		for j := i; j < len(lines); j++ {
+			if lines[j].Op != DiffEqual {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+
+		end += context
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		oldStart, oldCount := oldLine[start]+1, oldLine[end]-oldLine[start]
+		newStart, newCount := newLine[start]+1, newLine[end]-newLine[start]
+		if oldCount == 0 {
+			oldStart--
+		}
+		if newCount == 0 {
+			newStart--
+		}
+
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+		for _, line := range lines[start:end] {
+			prefix := " "
+			switch line.Op {
+			case DiffInsert:
+				prefix = "+"
+			case DiffDelete:
+				prefix = "-"
+			}
+
+			out.WriteString(prefix + line.Text)
+			if !strings.HasSuffix(line.Text, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		i = end
+	}
+
+	return out.String()
+}
+
+// StatGraph draws the +/- bar used by --stat, scaled down to at most width characters.
+func StatGraph(insertions int, deletions int, width int) string {
+	total := insertions + deletions
+	if total > width {
+		insertions = insertions * width / total
+		deletions = width - insertions
+	}
+	return strings.Repeat("+", insertions) + strings.Repeat("-", deletions)
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+var ErrLocked = errors.New("another subsys command is using this directory")
+
+// Lock keeps other subsys processes from changing a directory at the same
+// time. It's a file created in .subsys only when no other process holds it,
+// like git's index.lock.
+type Lock struct {
+	path string
+}
+
+func LockPath(root string) string {
+	return filepath.Join(root, ".subsys", "lock")
+}
+
+// LockDirectory takes the lock of the subsys directory root. A lock left by a
+// process that was stopped before it could release it is taken over, and the
+// temporary files it was writing are cleaned up.
+func LockDirectory(root string) (*Lock, error) {
+	path := LockPath(root)
+	owner := fmt.Sprintf("pid %d", os.Getpid())
+
+	err := createLock(path, owner)
+	if os.IsExist(err) {
+		if holder, stale := staleLock(path); stale {
+			err = takeOver(path, holder, owner)
+		}
+	}
+	if os.IsExist(err) {
+		holder, _ := os.ReadFile(path)
+		return nil, fmt.Errorf("%w (%s). If no other subsys is running, remove %s and try again",
+			ErrLocked, strings.TrimSpace(string(holder)), path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	removeLeftovers(root)
+	return &Lock{path: path}, nil
+}
+
+func createLock(path string, owner string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(owner)
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// takeOver replaces a stale lock with one of our own. Removing the stale lock
+// and creating a new one would let two processes that both found it stale
+// each remove the other's lock. Instead the new lock is renamed over it, which
+// no process ever sees half done, and read back: of the processes racing to
+// take it over, the one whose lock is left owns it.
+func takeOver(path string, stale string, owner string) error {
+	// Another process may have taken it over since it was found stale
+	current, err := os.ReadFile(path)
+	if err != nil || string(current) != stale {
+		return os.ErrExist
+	}
+
+	err = WriteFileAtomic(path, []byte(owner), 0644)
+	if err != nil {
+		return err
+	}
+
+	current, err = os.ReadFile(path)
+	if err != nil || string(current) != owner {
+		return os.ErrExist
+	}
+	return nil
+}
+
+// staleLock reports whether the process that took a lock has exited, returning
+// what the lock holds. A lock that can't be read is assumed to still be held.
+func staleLock(path string) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+
+	var pid int
+	_, err = fmt.Sscanf(string(data), "pid %d", &pid)
+	if err != nil {
+		return "", false
+	}
+
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return string(data), true
+	}
+
+	return string(data), errors.Is(process.Signal(syscall.Signal(0)), os.ErrProcessDone)
+}
+
+func (l *Lock) Unlock() error {
+	return os.Remove(l.path)
+}
+
+// removeLeftovers deletes the temporary files of objects, snapshots and the
+// tracker that were being written when a process holding the lock was
+// stopped. Nothing else can be writing them while the lock is held.
+func removeLeftovers(root string) {
+	for _, pattern := range []string{
+		filepath.Join(root, ".subsys", "objects", "tmp-*"),
+		filepath.Join(root, ".subsys", "snapshots", ".*.tmp-*"),
+		filepath.Join(root, ".subsys", ".*.tmp-*"),
+	} {
+		leftovers, _ := filepath.Glob(pattern)
+		for _, leftover := range leftovers {
+			os.Remove(leftover)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func SetupLockTests(t *testing.T) string {
+	root := t.TempDir()
+
+	for _, dir := range []string{"objects", "snapshots"} {
+		err := os.MkdirAll(filepath.Join(root, ".subsys", dir), 0777)
+		if err != nil {
+			t.Fatalf("Failed to create the subsys directory: %v", err)
+		}
+	}
+
+	return root
+}
+
+func TestLockDirectory(t *testing.T) {
+	root := SetupLockTests(t)
+
+	lock, err := LockDirectory(root)
+	if err != nil {
+		t.Fatalf("LockDirectory failed: %v", err)
+	}
+
+	data, err := os.ReadFile(LockPath(root))
+	if err != nil || string(data) != fmt.Sprintf("pid %d", os.Getpid()) {
+		t.Errorf("Expected the lock to name this process, got %q (%v)", data, err)
+	}
+
+	_, err = LockDirectory(root)
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected the directory to be locked, got %v", err)
+	}
+
+	err = lock.Unlock()
+	if err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if _, err := os.Stat(LockPath(root)); !os.IsNotExist(err) {
+		t.Errorf("Expected the lock to be removed once released")
+	}
+
+	lock, err = LockDirectory(root)
+	if err != nil {
+		t.Fatalf("Expected the released lock to be taken again, got %v", err)
+	}
+	lock.Unlock()
+}
+
+func TestLockTakesOverStaleLock(t *testing.T) {
+	root := SetupLockTests(t)
+
+	// A lock left by a process that no longer runs is taken over
+	os.WriteFile(LockPath(root), []byte("pid 2147483646"), 0644)
+	leftovers := []string{
+		filepath.Join(root, ".subsys", "objects", "tmp-123"),
+		filepath.Join(root, ".subsys", "snapshots", ".first.json.tmp-123"),
+		filepath.Join(root, ".subsys", "..track.tmp-123"),
+	}
+	for _, leftover := range leftovers {
+		os.WriteFile(leftover, []byte("partial"), 0644)
+	}
+
+	lock, err := LockDirectory(root)
+	if err != nil {
+		t.Fatalf("Expected a stale lock to be taken over, got %v", err)
+	}
+	defer lock.Unlock()
+
+	data, _ := os.ReadFile(LockPath(root))
+	if string(data) != fmt.Sprintf("pid %d", os.Getpid()) {
+		t.Errorf("Expected the lock to name this process, got %q", data)
+	}
+
+	for _, leftover := range leftovers {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("Expected the stale process's temporary file %s to be removed", leftover)
+		}
+	}
+}
+
+func TestTakeOverLosesRace(t *testing.T) {
+	root := SetupLockTests(t)
+	path := LockPath(root)
+
+	// Another process took the stale lock over first
+	os.WriteFile(path, []byte("pid 1"), 0644)
+
+	err := takeOver(path, "pid 2147483646", "pid 2")
+	if !os.IsExist(err) {
+		t.Errorf("Expected the lock to be left to the process that took it over, got %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if string(data) != "pid 1" {
+		t.Errorf("Expected the other process's lock to be kept, got %q", data)
+	}
+}
+
+func TestLockHeldByUnreadableOwner(t *testing.T) {
+	root := SetupLockTests(t)
+
+	// A lock that's still being written, or that something else wrote, is kept
+	os.WriteFile(LockPath(root), []byte(""), 0644)
+
+	_, err := LockDirectory(root)
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected a lock that can't be read to be kept, got %v", err)
+	}
+}
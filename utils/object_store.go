@@ -0,0 +1,290 @@
+package utils
+
+import (
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// StoredObject describes a file's contents as they are kept in the object
+// store: deflated, and named after the SHA-256 of the uncompressed data. The
+// CRC-32 is kept so the blob can be copied into a zip without recompressing it.
+type StoredObject struct {
+	Hash  string
+	CRC32 uint32
+	Size  int64
+}
+
+// CompressionLevel is the level every object is deflated at. Archives copy the
+// deflated objects as they are, so it must never change for archives of the
+// same snapshot to stay byte-identical.
+const CompressionLevel = flate.DefaultCompression
+
+var objectHash = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ValidObjectHash reports whether hash is a hex SHA-256, the only names
+// objects have. Hashes come from snapshots that may have been made elsewhere,
+// so they're checked before being turned into paths.
+func ValidObjectHash(hash string) bool {
+	return objectHash.MatchString(hash)
+}
+
+func ObjectPath(hash string) (string, error) {
+	if !ValidObjectHash(hash) {
+		return "", fmt.Errorf("invalid object hash %q", hash)
+	}
+	return filepath.Join(".subsys", "objects", hash[:2], hash[2:]), nil
+}
+
+func HasObject(hash string) bool {
+	path, err := ObjectPath(hash)
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// HashFile computes a file's SHA-256 and CRC-32 in a single read.
+func HashFile(path string) (StoredObject, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return StoredObject{}, err
+	}
+	defer file.Close()
+
+	return HashReader(file)
+}
+
+func HashReader(r io.Reader) (StoredObject, error) {
+	hasher := sha256.New()
+	crc := crc32.NewIEEE()
+
+	size, err := io.Copy(io.MultiWriter(hasher, crc), r)
+	if err != nil {
+		return StoredObject{}, err
+	}
+
+	return StoredObject{
+		Hash:  hex.EncodeToString(hasher.Sum(nil)),
+		CRC32: crc.Sum32(),
+		Size:  size,
+	}, nil
+}
+
+// StoreFile hashes and deflates a file in a single read, and adds it to the
+// object store unless identical contents are already there.
+func StoreFile(path string) (StoredObject, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return StoredObject{}, err
+	}
+	defer src.Close()
+
+	return StoreReader(src)
+}
+
+func StoreReader(src io.Reader) (StoredObject, error) {
+	objectsDir := filepath.Join(".subsys", "objects")
+	err := os.MkdirAll(objectsDir, 0777)
+	if err != nil {
+		return StoredObject{}, err
+	}
+
+	tmp, err := os.CreateTemp(objectsDir, "tmp-")
+	if err != nil {
+		return StoredObject{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	writer, err := flate.NewWriter(tmp, CompressionLevel)
+	if err != nil {
+		return StoredObject{}, err
+	}
+
+	hasher := sha256.New()
+	crc := crc32.NewIEEE()
+
+	size, err := io.Copy(io.MultiWriter(hasher, crc, writer), src)
+	if err != nil {
+		return StoredObject{}, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return StoredObject{}, err
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		return StoredObject{}, err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return StoredObject{}, err
+	}
+
+	object := StoredObject{
+		Hash:  hex.EncodeToString(hasher.Sum(nil)),
+		CRC32: crc.Sum32(),
+		Size:  size,
+	}
+
+	if HasObject(object.Hash) {
+		return object, nil
+	}
+
+	objectPath, err := ObjectPath(object.Hash)
+	if err != nil {
+		return StoredObject{}, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(objectPath), 0777)
+	if err != nil {
+		return StoredObject{}, err
+	}
+
+	return object, os.Rename(tmp.Name(), objectPath)
+}
+
+// StoreRawObject adds an object that is already deflated, such as one copied
+// from another store, after checking that its contents match hash.
+func StoreRawObject(hash string, deflated io.Reader) error {
+	if !ValidObjectHash(hash) {
+		return fmt.Errorf("invalid object hash %q", hash)
+	}
+
+	objectsDir := filepath.Join(".subsys", "objects")
+	err := os.MkdirAll(objectsDir, 0777)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(objectsDir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hasher := sha256.New()
+	source := io.TeeReader(deflated, tmp)
+	_, err = io.Copy(hasher, flate.NewReader(source))
+	if err != nil {
+		return fmt.Errorf("object %s is corrupt: %v", hash, err)
+	}
+
+	// Keep anything after the end of the deflate stream, as it was
+	_, err = io.Copy(io.Discard, source)
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(hasher.Sum(nil)) != hash {
+		return fmt.Errorf("object %s is corrupt, its contents don't match its hash", hash)
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	if HasObject(hash) {
+		return nil
+	}
+
+	objectPath, err := ObjectPath(hash)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(objectPath), 0777)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), objectPath)
+}
+
+type objectReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (r *objectReader) Close() error {
+	r.ReadCloser.Close()
+	return r.file.Close()
+}
+
+// ReadObject returns the decompressed contents of a stored blob.
+func ReadObject(hash string) (io.ReadCloser, error) {
+	file, err := OpenRawObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &objectReader{ReadCloser: flate.NewReader(file), file: file}, nil
+}
+
+// OpenRawObject opens a stored blob without decompressing it.
+func OpenRawObject(hash string) (*os.File, error) {
+	path, err := ObjectPath(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+// PruneObjects removes every stored object whose hash isn't in keep. Temporary
+// files of a store in progress are left alone.
+func PruneObjects(keep map[string]bool) (int, int64, error) {
+	objectsDir := filepath.Join(".subsys", "objects")
+
+	removed := 0
+	var freed int64
+	err := filepath.Walk(objectsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return filepath.SkipAll
+			}
+			return err
+		}
+
+		if info.IsDir() || strings.HasPrefix(info.Name(), "tmp-") {
+			return nil
+		}
+
+		hash := filepath.Base(filepath.Dir(path)) + info.Name()
+		if keep[hash] {
+			return nil
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+
+		removed++
+		freed += info.Size()
+		os.Remove(filepath.Dir(path))
+		return nil
+	})
+
+	return removed, freed, err
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// RootEnv names the environment variable that points subsys at a directory,
+// instead of looking for one from the working directory.
+const RootEnv = "SUBSYS_DIR"
+
+var ErrNoRoot = errors.New("this is not a subsys directory, nor are any of its parents")
+
+// Prefix is the directory subsys was run from, relative to the root it
+// changed into. It's empty when run from the root itself.
+var Prefix string
+
+// FindRoot returns the closest directory, starting with dir and going up,
+// that has a .subsys directory.
+func FindRoot(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		info, err := os.Stat(filepath.Join(dir, ".subsys"))
+		if err == nil && info.IsDir() {
+			return dir, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", ErrNoRoot
+		}
+		dir = parent
+	}
+}
+
+// EnterRoot changes into the subsys directory, so every path can be relative
+// to it. The directory is root if given, then the one in SUBSYS_DIR, and
+// otherwise the closest one above the working directory. Without any, the
+// working directory is kept and commands report it isn't a subsys directory.
+func EnterRoot(root string) error {
+	if root == "" {
+		root = os.Getenv(RootEnv)
+	}
+
+	working, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	if root == "" {
+		root, err = FindRoot(working)
+		if errors.Is(err, ErrNoRoot) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s isn't a directory", root)
+	}
+
+	err = os.Chdir(root)
+	if err != nil {
+		return err
+	}
+
+	Prefix, err = filepath.Rel(root, working)
+	if err != nil {
+		return err
+	}
+	if Prefix == "." {
+		Prefix = ""
+	}
+
+	return nil
+}
+
+// UserPath makes a path the user gave, relative to where they ran subsys,
+// relative to the root instead.
+func UserPath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(Prefix, path)
+}
@@ -2,26 +2,24 @@ package utils
 
 import (
 	"errors"
-	"fmt"
+	"os"
 	"os/exec"
 )
 
-func RunCommand(command string) (string, error) {
+// RunCommand runs a command in dir with env added to the environment. Its
+// output goes straight to the terminal, so long running commands like test
+// suites show their progress.
+func RunCommand(dir string, env []string, command string, args ...string) error {
 	if command == "" {
-		return "", errors.New("no command provided")
+		return errors.New("no command provided")
 	}
 
-	args := []string{"-l"}
-
 	cmd := exec.Command(command, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		fmt.Printf("Error running command: %v\n", err)
-		return "", err
-	}
-
-	fmt.Printf("Command Output:\n%s\n", string(output))
-
-	return "Command run successfully", nil
+	return cmd.Run()
 }
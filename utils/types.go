@@ -5,6 +5,15 @@ type AssignmentConfig struct {
 	Directory      string
 	StudentID      string
 	AssignmentCode string
+	HonorGitignore bool   `json:",omitempty"`
+	ArchiveFormat  string `json:",omitempty"`
+
+	// PublicKey is the student's registered Ed25519 key, base64 encoded
+	PublicKey string `json:",omitempty"`
+
+	// LecturerKey is the lecturer's X25519 key, base64 encoded. When it's set
+	// archives are encrypted to it before they're submitted.
+	LecturerKey string `json:",omitempty"`
 }
 
 type ServerError struct {
@@ -0,0 +1,3 @@
+package utils
+
+const Version = "0.0.1"